@@ -0,0 +1,56 @@
+//-----------------------------------------------------------------------------
+// Package membership:
+//-----------------------------------------------------------------------------
+
+package main
+
+//-----------------------------------------------------------------------------
+// Interfaces definitions:
+//-----------------------------------------------------------------------------
+
+// blockBackend performs the block storage operations: RBD images, their
+// metadata and locks.
+type blockBackend interface {
+
+	// Images:
+	listImages(pool string) ([]string, error)
+	infoImage(pool, name string) (*imageInfo, error)
+	usageImage(pool, name string) (uint64, error)
+	listSnapshots(pool, name string) ([]string, error)
+	createImage(pool, name string, size int, features []string) error
+	removeImage(pool, name string) error
+	renameImage(pool, name, newName string) error
+	purgeSnapshots(pool, name string) error
+	disableFeatures(pool, name string, features []string) error
+
+	// Metadata:
+	setImageMeta(pool, name, key, value string) error
+	getImageMeta(pool, name, key string) (string, error)
+	removeImageMeta(pool, name, key string) error
+
+	// Locks:
+	lockImage(pool, name, lockID string) error
+	listLocks(pool, name string) ([]lockHolder, error)
+	unlockImage(pool, name, lockID, locker string) error
+
+	// Fencing:
+	listWatchers(pool, name string) ([]string, error)
+	blocklistClient(address string) error
+}
+
+// mapper maps RBD images to block devices on the local host.
+type mapper interface {
+	mapImage(pool, name string, opts mapOpts) (string, error)
+	unmapImage(device string) error
+	showMapped() (map[string]mapping, error)
+}
+
+// hostBackend performs the operations on the local host: file systems and
+// mounts.
+type hostBackend interface {
+	makeFs(device, fsType, mkfsOpts string) error
+	mountDevice(device, mountpoint, fsType, mntOpts string) error
+	unmountDevice(device string) error
+	probeDevice(device string) (string, string, error)
+	listMounts(root string) (map[string]string, error)
+}
@@ -0,0 +1,130 @@
+//-----------------------------------------------------------------------------
+// Package membership:
+//-----------------------------------------------------------------------------
+
+package main
+
+//-----------------------------------------------------------------------------
+// Imports:
+//-----------------------------------------------------------------------------
+
+import (
+
+	// Standard library:
+	"errors"
+	"path/filepath"
+	"strings"
+)
+
+//-----------------------------------------------------------------------------
+// Structs definitions:
+//-----------------------------------------------------------------------------
+
+// cluster is a named Ceph cluster profile with its own connection options
+// and managed pools.
+type cluster struct {
+	name    string
+	defPool string
+	pools   []string
+	rbd     blockBackend
+	mappers map[string]mapper
+}
+
+//-----------------------------------------------------------------------------
+// newCluster
+//-----------------------------------------------------------------------------
+
+func newCluster(name string, cfg clusterConfig, rbd blockBackend, mappers map[string]mapper) *cluster {
+
+	// Default pool
+	defPool := cfg.Pool
+	if defPool == "" {
+		defPool = "rbd"
+	}
+
+	// The default pool is always managed
+	managed := []string{defPool}
+	for _, pool := range cfg.Pools {
+		if pool = strings.TrimSpace(pool); pool != "" && pool != defPool {
+			managed = append(managed, pool)
+		}
+	}
+
+	return &cluster{
+		name:    name,
+		defPool: defPool,
+		pools:   managed,
+		rbd:     rbd,
+		mappers: mappers,
+	}
+}
+
+//-----------------------------------------------------------------------------
+// isManaged
+//-----------------------------------------------------------------------------
+
+func (cl *cluster) isManaged(pool string) bool {
+	for _, p := range cl.pools {
+		if p == pool {
+			return true
+		}
+	}
+	return false
+}
+
+//-----------------------------------------------------------------------------
+// mapperFor returns the mapper of a mapping mode.
+//-----------------------------------------------------------------------------
+
+func (cl *cluster) mapperFor(mode string) (mapper, error) {
+	m, found := cl.mappers[mode]
+	if !found {
+		return nil, errors.New("Mapping mode " + mode + " is not available")
+	}
+	return m, nil
+}
+
+//-----------------------------------------------------------------------------
+// clusterList returns the clusters, the default one first.
+//-----------------------------------------------------------------------------
+
+func (d *rbdDriver) clusterList() []*cluster {
+	list := []*cluster{}
+	for _, name := range d.order {
+		list = append(list, d.clusters[name])
+	}
+	return list
+}
+
+//-----------------------------------------------------------------------------
+// mountpoint
+//-----------------------------------------------------------------------------
+
+func (d *rbdDriver) mountpoint(cl *cluster, pool, name string) string {
+
+	// Volumes mounted by versions without cluster profiles
+	if cl.name == d.defCluster {
+		legacy := filepath.Join(d.volRoot, pool, name)
+		if _, found := d.getVolume(legacy); found {
+			return legacy
+		}
+	}
+
+	return filepath.Join(d.volRoot, cl.name, pool, name)
+}
+
+//-----------------------------------------------------------------------------
+// volumeName returns the shortest name that resolves to the image.
+//-----------------------------------------------------------------------------
+
+func (d *rbdDriver) volumeName(cl *cluster, pool, name string) string {
+
+	switch {
+	case cl.name != d.defCluster:
+		return cl.name + "/" + pool + "/" + name
+	case pool != cl.defPool:
+		return pool + "/" + name
+	}
+
+	return name
+}
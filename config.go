@@ -0,0 +1,160 @@
+//-----------------------------------------------------------------------------
+// Package membership:
+//-----------------------------------------------------------------------------
+
+package main
+
+//-----------------------------------------------------------------------------
+// Imports:
+//-----------------------------------------------------------------------------
+
+import (
+
+	// Standard library:
+	"encoding/json"
+	"errors"
+	"flag"
+	"io/ioutil"
+	"sort"
+	"strings"
+)
+
+//-----------------------------------------------------------------------------
+// Structs definitions:
+//-----------------------------------------------------------------------------
+
+// cephConn holds the options used to connect and authenticate to a cluster.
+type cephConn struct {
+	cluster string
+	id      string
+	keyring string
+	keyfile string
+	conf    string
+	mon     string
+}
+
+// clusterConfig is a cluster profile as found in the config file.
+type clusterConfig struct {
+	Cluster string   `json:"cluster"`
+	ID      string   `json:"id"`
+	Keyring string   `json:"keyring"`
+	Keyfile string   `json:"keyfile"`
+	Conf    string   `json:"conf"`
+	Mon     string   `json:"mon"`
+	Pool    string   `json:"pool"`
+	Pools   []string `json:"pools"`
+	Mapper  string   `json:"mapper"`
+}
+
+//-----------------------------------------------------------------------------
+// conn
+//-----------------------------------------------------------------------------
+
+func (c clusterConfig) conn() cephConn {
+	return cephConn{
+		cluster: c.Cluster,
+		id:      c.ID,
+		keyring: c.Keyring,
+		keyfile: c.Keyfile,
+		conf:    c.Conf,
+		mon:     c.Mon,
+	}
+}
+
+//-----------------------------------------------------------------------------
+// args returns the command line options for the ceph tools. Empty values are
+// left to the ceph defaults.
+//-----------------------------------------------------------------------------
+
+func (c cephConn) args() []string {
+
+	args := []string{}
+	opts := [][2]string{
+		{"--cluster", c.cluster},
+		{"--id", c.id},
+		{"--keyring", c.keyring},
+		{"--keyfile", c.keyfile},
+		{"--conf", c.conf},
+		{"--mon_host", c.mon},
+	}
+
+	for _, o := range opts {
+		if o[1] != "" {
+			args = append(args, o[0], o[1])
+		}
+	}
+
+	return args
+}
+
+//-----------------------------------------------------------------------------
+// loadConfig reads a JSON object whose keys are flag names, plus an optional
+// "clusters" object of named cluster profiles. Flags given in the command
+// line take precedence over the config file.
+//-----------------------------------------------------------------------------
+
+func loadConfig(file string) (map[string]clusterConfig, error) {
+
+	profiles := map[string]clusterConfig{}
+
+	// Read the file
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, errors.New("Unable to read config file " + file)
+	}
+
+	entries := map[string]json.RawMessage{}
+	if err = json.Unmarshal(data, &entries); err != nil {
+		return nil, errors.New("Unable to parse config file " + file + ": " + err.Error())
+	}
+
+	// Flags set in the command line
+	set := map[string]bool{}
+	flag.Visit(func(f *flag.Flag) { set[f.Name] = true })
+
+	// Apply the entries
+	unknown := []string{}
+	for key, raw := range entries {
+
+		// Cluster profiles
+		if key == "clusters" {
+			if err = json.Unmarshal(raw, &profiles); err != nil {
+				return nil, errors.New("Invalid config entry clusters: " + err.Error())
+			}
+			continue
+		}
+
+		if flag.Lookup(key) == nil || key == "config" {
+			unknown = append(unknown, key)
+			continue
+		}
+
+		if set[key] {
+			continue
+		}
+
+		// Strings are unquoted, numbers and booleans taken verbatim
+		value := string(raw)
+		if err = json.Unmarshal(raw, &value); err != nil {
+			value = string(raw)
+		}
+
+		if err = flag.Set(key, value); err != nil {
+			return nil, errors.New("Invalid config entry " + key + ": " + err.Error())
+		}
+	}
+
+	if len(unknown) > 0 {
+		sort.Strings(unknown)
+		return nil, errors.New("Unknown config entries: " + strings.Join(unknown, ", "))
+	}
+
+	// Validate the profile names
+	for name := range profiles {
+		if !poolRegex.MatchString(name) {
+			return nil, errors.New("Invalid cluster profile name: " + name)
+		}
+	}
+
+	return profiles, nil
+}
@@ -15,10 +15,12 @@ import (
 	"log"
 	"os"
 	"os/exec"
-	"path/filepath"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	// Community:
 	dkvolume "github.com/docker/go-plugins-helpers/volume"
@@ -28,16 +30,55 @@ import (
 // Package constant declarations:
 //-----------------------------------------------------------------------------
 
-const lockID = "dockerLock"
+const (
+
+	// Remove policies:
+	removeDelete = "delete"
+	removeKeep   = "keep"
+	removeRename = "rename"
+
+	// Prefix for renamed images:
+	tombstone = "zz_deleted_"
+
+	// Image metadata keys:
+	metaPrefix  = "docker-volume-rbd."
+	metaOwner   = metaPrefix + "owner"
+	metaFsType  = metaPrefix + "fstype"
+	metaMkfs    = metaPrefix + "mkfsopts"
+	metaMntOpts = metaPrefix + "mntopts"
+	metaSize    = metaPrefix + "size"
+	metaCreated = metaPrefix + "created"
+
+	metaMapping  = metaPrefix + "mapping"
+	metaLockWait = metaPrefix + "lockwait"
+	metaLease    = metaPrefix + "lease"
+	metaLocking  = metaPrefix + "locking"
+	metaClient   = metaPrefix + "client"
+
+	// Interval between attempts to take a busy lock:
+	lockPoll = 5 * time.Second
+
+	// Mappers:
+	mapperCLI   = "cli"
+	mapperSysfs = "sysfs"
+
+	// Mapping modes:
+	mappingKRBD = "krbd"
+	mappingNBD  = "nbd"
+
+	// Locking strategies:
+	lockingAdvisory  = "advisory"
+	lockingExclusive = "exclusive"
+	lockingNone      = "none"
+)
 
 //-----------------------------------------------------------------------------
 // Package variable declarations factored into a block:
 //-----------------------------------------------------------------------------
 
 var (
-	commands  = [...]string{"modprobe", "rbd", "mount", "umount"}
-	nameRegex = regexp.MustCompile(`^(([-_.[:alnum:]]+)/)?([-_.[:alnum:]]+)(@([0-9]+))?$`)
-	lockRegex = regexp.MustCompile(`^(client.[0-9]+) ` + lockID)
+	commands  = [...]string{"modprobe", "rbd", "mount", "umount", "blkid"}
+	nameRegex = regexp.MustCompile(`^((([-_.[:alnum:]]+)/)?([-_.[:alnum:]]+)/)?([-_.[:alnum:]]+)(@([0-9]+))?$`)
 )
 
 //-----------------------------------------------------------------------------
@@ -45,54 +86,241 @@ var (
 //-----------------------------------------------------------------------------
 
 type volume struct {
+	name    string
+	device  string
+	lockID  string
+	locker  string
+	fstype  string
+	pool    string
+	cluster string
+	mapping string
+	locking string
+	ids     map[string]struct{}
+	lease   leaseStatus
+
+	// Release progress, so a failed release can be retried:
+	unmounted bool
+	unmapped  bool
+}
+
+type mapping struct {
+	pool   string
 	name   string
 	device string
-	locker string
-	fstype string
-	pool   string
+	mode   string
+}
+
+type mapOpts struct {
+	exclusive bool
+	readOnly  bool
+}
+
+type imageInfo struct {
+	size     uint64
+	features []string
 }
 
 type rbdDriver struct {
-	volRoot   string
-	defPool   string
-	defFsType string
-	defSize   int
-	cmd       map[string]string
-	volumes   map[string]*volume
+	volRoot    string
+	defFsType  string
+	defSize    int
+	defCluster string
+	defMapping string
+	defLocking string
+	features   []string
+	fixFeat    bool
+	clusters   map[string]*cluster
+	order      []string
+	ownedOnly  bool
+	remove     string
+	purgeSnaps bool
+	takeover   bool
+	grace      time.Duration
+	lockWait   time.Duration
+	leaseTTL   time.Duration
+	hostname   string
+	instance   string
+	host       hostBackend
+
+	// Guards volumes, locks and closing:
+	mutex   sync.Mutex
+	volumes map[string]*volume
+	locks   map[string]*volumeLock
+	closing bool
+
+	// API requests in flight:
+	inflight sync.WaitGroup
+}
+
+// driverOpts holds the daemon settings, built from the flags in main.
+type driverOpts struct {
+	volRoot    string
+	sysfsRoot  string
+	defFsType  string
+	defSize    int
+	profiles   map[string]clusterConfig
+	defCluster string
+	defMapping string
+	defLocking string
+	runner     *runner
+	features   []string
+	fixFeat    bool
+	ownedOnly  bool
+	remove     string
+	purgeSnaps bool
+	takeover   bool
+	grace      time.Duration
+	lockWait   time.Duration
+	leaseTTL   time.Duration
 }
 
 //-----------------------------------------------------------------------------
 // initDriver
 //-----------------------------------------------------------------------------
 
-func initDriver(volRoot, defPool, defFsType string, defSize int) rbdDriver {
+func initDriver(o driverOpts) *rbdDriver {
 
 	// Variables
 	var err error
 	cmd := make(map[string]string)
+	r := o.runner
+	defMapping := o.defMapping
+
+	// Validate the remove policy
+	switch o.remove {
+	case removeDelete, removeKeep, removeRename:
+	default:
+		log.Fatalf("[Init] ERROR unknown remove policy %s", o.remove)
+	}
 
 	// Search for binaries
 	for _, i := range commands {
 		cmd[i], err = exec.LookPath(i)
 		if err != nil {
-			log.Fatal("[Init] ERROR make sure binary %s is in your PATH", i)
+			log.Fatalf("[Init] ERROR make sure binary %s is in your PATH", i)
 		}
 	}
 
-	// Load RBD kernel module
-	log.Printf("[Init] INFO loading RBD kernel module...")
-	if err = exec.Command(cmd["modprobe"], "rbd").Run(); err != nil {
-		log.Fatal("[Init] ERROR unable to load RBD kernel module")
+	// rbd-nbd is optional unless it is the default
+	if cmd["rbd-nbd"], err = exec.LookPath("rbd-nbd"); err != nil && defMapping == mappingNBD {
+		log.Fatal("[Init] ERROR make sure binary rbd-nbd is in your PATH")
+	}
+
+	// ceph is only needed to fence the holders of stale locks
+	if cmd["ceph"], err = exec.LookPath("ceph"); err != nil && o.takeover {
+		log.Fatal("[Init] ERROR make sure binary ceph is in your PATH")
+	}
+
+	// Load the kernel modules, the one of the default mode is mandatory.
+	// modprobe is the only command run without a deadline.
+	modules := map[string]string{mappingKRBD: "rbd", mappingNBD: "nbd"}
+	if _, found := modules[defMapping]; !found {
+		log.Fatalf("[Init] ERROR unknown mapping mode %s", defMapping)
+	}
+
+	for mode, module := range modules {
+		if mode == mappingNBD && cmd["rbd-nbd"] == "" {
+			continue
+		}
+		log.Printf("[Init] INFO loading %s kernel module...", module)
+		if err = exec.Command(cmd["modprobe"], module).Run(); err != nil {
+			if mode == defMapping {
+				log.Fatalf("[Init] ERROR unable to load %s kernel module", module)
+			}
+			log.Printf("[Init] WARN unable to load %s kernel module, %s mapping may fail", module, mode)
+			if mode == mappingNBD {
+				delete(cmd, "rbd-nbd")
+			}
+		}
 	}
 
 	// Initialize the struct
-	driver := rbdDriver{
-		volRoot:   volRoot,
-		defPool:   defPool,
-		defFsType: defFsType,
-		defSize:   defSize,
-		cmd:       cmd,
-		volumes:   map[string]*volume{},
+	driver := &rbdDriver{
+		volRoot:    o.volRoot,
+		defFsType:  o.defFsType,
+		defSize:    o.defSize,
+		defCluster: o.defCluster,
+		defMapping: o.defMapping,
+		defLocking: o.defLocking,
+		features:   o.features,
+		fixFeat:    o.fixFeat,
+		clusters:   map[string]*cluster{},
+		order:      []string{o.defCluster},
+		ownedOnly:  o.ownedOnly,
+		remove:     o.remove,
+		purgeSnaps: o.purgeSnaps,
+		takeover:   o.takeover,
+		grace:      o.grace,
+		lockWait:   o.lockWait,
+		leaseTTL:   o.leaseTTL,
+		instance:   newInstanceID(),
+		host:       newHostCLI(cmd, r),
+		volumes:    map[string]*volume{},
+		locks:      map[string]*volumeLock{},
+	}
+
+	// Validate the default locking strategy
+	if _, err = driver.strategyFor(o.defLocking); err != nil {
+		log.Fatalf("[Init] ERROR %s", err)
+	}
+
+	// Identify this host in the lock IDs
+	if driver.hostname, err = os.Hostname(); err != nil {
+		log.Fatalf("[Init] ERROR unable to get the hostname: %s", err)
+	}
+	log.Printf("[Init] INFO locking as %s", driver.lockID(""))
+
+	// The default cluster goes first
+	names := []string{}
+	for name := range o.profiles {
+		if name != o.defCluster {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	driver.order = append(driver.order, names...)
+
+	// Set up the cluster profiles
+	for _, name := range driver.order {
+
+		// Choose how images are mapped
+		cfg := o.profiles[name]
+		rbd := newRBDCLI(cmd, cfg.conn(), r)
+		var m mapper = rbd
+
+		switch cfg.Mapper {
+		case "", mapperCLI:
+		case mapperSysfs:
+			if m, err = newSysfsMapper(o.sysfsRoot, cfg.conn(), r); err != nil {
+				log.Fatalf("[Init] ERROR setting up sysfs mapper for cluster %s: %s", name, err)
+			}
+		default:
+			log.Fatalf("[Init] ERROR unknown mapper %s for cluster %s", cfg.Mapper, name)
+		}
+
+		// The mappers for each mode
+		mappers := map[string]mapper{mappingKRBD: m}
+		if cmd["rbd-nbd"] != "" {
+			mappers[mappingNBD] = newNBDCLI(cmd, cfg.conn(), r)
+		}
+
+		cl := newCluster(name, cfg, rbd, mappers)
+		driver.clusters[name] = cl
+
+		// Check the credentials
+		log.Printf("[Init] INFO listing pool %s in cluster %s...", cl.defPool, name)
+		if _, err = cl.rbd.listImages(cl.defPool); err != nil {
+			log.Fatalf("[Init] ERROR unable to list pool %s in cluster %s, check the Ceph connection and credentials: %s", cl.defPool, name, err)
+		}
+	}
+
+	// Rebuild the volume table after a restart
+	log.Printf("[Init] INFO recovering volume state...")
+	driver.recover()
+
+	// Keep the leases of the mounted volumes alive
+	if o.leaseTTL > 0 {
+		go driver.renewLeases()
 	}
 
 	return driver
@@ -124,24 +352,55 @@ func initDriver(volRoot, defPool, defFsType string, defSize int) rbdDriver {
 
 func (d *rbdDriver) Create(r dkvolume.Request) dkvolume.Response {
 
+	// Refuse new requests while shutting down
+	if err := d.enter(); err != nil {
+		log.Printf("[Create] ERROR %s", err)
+		return dkvolume.Response{Err: err.Error()}
+	}
+	defer d.leave()
+
 	// Parse the docker --volume option
-	pool, name, size, err := d.parsePoolNameSize(r.Name)
+	cl, pool, name, size, err := d.resolveName(r.Name)
 	if err != nil {
 		log.Printf("[Create] ERROR parsing volume: %s", err)
 		return dkvolume.Response{Err: err.Error()}
 	}
 
+	// Parse the driver options
+	opts, err := d.parseOpts(cl, pool, size, r.Options)
+	if err != nil {
+		log.Printf("[Create] ERROR parsing options: %s", err)
+		return dkvolume.Response{Err: err.Error()}
+	}
+
+	// The cluster and pool can only be set once
+	if opts.cluster != cl || opts.pool != pool {
+		if strings.Contains(r.Name, "/") {
+			err = errors.New("Conflicting cluster or pool in volume name and options")
+		} else if exists, _ := d.imageExists(cl, pool, name); exists {
+			err = errors.New("Volume already exists in " + cl.name + "/" + pool)
+		}
+		if err != nil {
+			log.Printf("[Create] ERROR parsing options: %s", err)
+			return dkvolume.Response{Err: err.Error()}
+		}
+		cl, pool = opts.cluster, opts.pool
+	}
+
+	// Serialize operations on this volume
+	defer d.lockVolume(cl, pool, name)()
+
 	// Check if volume already exists
-	mountpoint := filepath.Join(d.volRoot, pool, name)
-	if _, found := d.volumes[mountpoint]; found {
+	mountpoint := d.mountpoint(cl, pool, name)
+	if _, found := d.getVolume(mountpoint); found {
 		log.Println("[Create] INFO volume is already in known mounts: " + mountpoint)
 		return dkvolume.Response{}
 	}
 
 	// Create RBD image if not exists
-	if exists, err := d.imageExists(pool, name); !exists && err == nil {
+	if exists, err := d.imageExists(cl, pool, name); !exists && err == nil {
 		log.Println("[Create] INFO image does not exists. Creating it now...")
-		if err = d.createImage(pool, name, d.defFsType, size); err != nil {
+		if err = d.createImage(cl, pool, name, opts); err != nil {
 			return dkvolume.Response{Err: err.Error()}
 		}
 	} else if err != nil {
@@ -174,6 +433,84 @@ func (d *rbdDriver) Create(r dkvolume.Request) dkvolume.Response {
 //-----------------------------------------------------------------------------
 
 func (d *rbdDriver) Remove(r dkvolume.Request) dkvolume.Response {
+
+	// Refuse new requests while shutting down
+	if err := d.enter(); err != nil {
+		log.Printf("[Remove] ERROR %s", err)
+		return dkvolume.Response{Err: err.Error()}
+	}
+	defer d.leave()
+
+	// Parse the docker --volume option
+	cl, pool, name, _, err := d.resolveName(r.Name)
+	if err != nil {
+		log.Printf("[Remove] ERROR parsing volume: %s", err)
+		return dkvolume.Response{Err: err.Error()}
+	}
+
+	// Serialize operations on this volume
+	defer d.lockVolume(cl, pool, name)()
+
+	// Refuse to remove a mounted volume
+	mountpoint := d.mountpoint(cl, pool, name)
+	if _, found := d.getVolume(mountpoint); found {
+		err = errors.New("Volume is mounted: " + mountpoint)
+		log.Printf("[Remove] ERROR removing volume: %s", err)
+		return dkvolume.Response{Err: err.Error()}
+	}
+
+	// Nothing to do if the image is already gone
+	if exists, err := d.imageExists(cl, pool, name); !exists && err == nil {
+		log.Printf("[Remove] INFO image %s does not exist", name)
+		return dkvolume.Response{}
+	} else if err != nil {
+		log.Printf("[Remove] ERROR checking for RBD Image: %s", err)
+		return dkvolume.Response{Err: err.Error()}
+	}
+
+	// Refuse to remove an image locked by any client
+	locks, err := d.imageLocks(cl, pool, name)
+	if err != nil {
+		log.Printf("[Remove] ERROR listing locks: %s", err)
+		return dkvolume.Response{Err: err.Error()}
+	}
+
+	if len(locks) > 0 {
+		err = errors.New("Image is locked by " + holders(locks))
+		log.Printf("[Remove] ERROR removing volume: %s", err)
+		return dkvolume.Response{Err: err.Error()}
+	}
+
+	// Apply the remove policy
+	switch d.remove {
+
+	case removeKeep:
+		log.Printf("[Remove] INFO keeping image %s", name)
+
+	case removeRename:
+		newName := tombstone + name + "_" + strconv.FormatInt(time.Now().Unix(), 10)
+		log.Printf("[Remove] INFO renaming image %s to %s", name, newName)
+		if err = cl.rbd.renameImage(pool, name, newName); err != nil {
+			log.Printf("[Remove] ERROR renaming image: %s", err)
+			return dkvolume.Response{Err: err.Error()}
+		}
+
+	case removeDelete:
+		if d.purgeSnaps {
+			log.Printf("[Remove] INFO purging snapshots of image %s", name)
+			if err = cl.rbd.purgeSnapshots(pool, name); err != nil {
+				log.Printf("[Remove] ERROR purging snapshots: %s", err)
+				return dkvolume.Response{Err: err.Error()}
+			}
+		}
+
+		log.Printf("[Remove] INFO deleting image %s", name)
+		if err = cl.rbd.removeImage(pool, name); err != nil {
+			log.Printf("[Remove] ERROR deleting image: %s", err)
+			return dkvolume.Response{Err: err.Error()}
+		}
+	}
+
 	return dkvolume.Response{}
 }
 
@@ -201,14 +538,21 @@ func (d *rbdDriver) Remove(r dkvolume.Request) dkvolume.Response {
 
 func (d *rbdDriver) Path(r dkvolume.Request) dkvolume.Response {
 
+	// Refuse new requests while shutting down
+	if err := d.enter(); err != nil {
+		log.Printf("[Path] ERROR %s", err)
+		return dkvolume.Response{Err: err.Error()}
+	}
+	defer d.leave()
+
 	// Parse the docker --volume option
-	pool, name, _, err := d.parsePoolNameSize(r.Name)
+	cl, pool, name, _, err := d.resolveName(r.Name)
 	if err != nil {
 		log.Printf("[Path] ERROR parsing volume: %s", err)
 		return dkvolume.Response{Err: err.Error()}
 	}
 
-	mountpoint := filepath.Join(d.volRoot, pool, name)
+	mountpoint := d.mountpoint(cl, pool, name)
 	return dkvolume.Response{Mountpoint: mountpoint}
 }
 
@@ -218,7 +562,8 @@ func (d *rbdDriver) Path(r dkvolume.Request) dkvolume.Response {
 // Request:
 //
 //  {
-//     "Name": "volume_name"
+//     "Name": "volume_name",
+//     "ID": "b87d7442095999a92b65b3d9691e697b61713829cc0ffd1bb72e4ccd51aa4d6c"
 //  }
 //
 //  Docker requires the plugin to provide a volume, given a user specified
@@ -238,61 +583,184 @@ func (d *rbdDriver) Path(r dkvolume.Request) dkvolume.Response {
 //  made available, and/or a string error if an error occurred.
 //-----------------------------------------------------------------------------
 
-func (d *rbdDriver) Mount(r dkvolume.Request) dkvolume.Response {
+func (d *rbdDriver) Mount(r dkvolume.MountRequest) dkvolume.Response {
+
+	// Refuse new requests while shutting down
+	if err := d.enter(); err != nil {
+		log.Printf("[Mount] ERROR %s", err)
+		return dkvolume.Response{Err: err.Error()}
+	}
+	defer d.leave()
 
 	// Parse the docker --volume option
-	pool, name, _, err := d.parsePoolNameSize(r.Name)
+	cl, pool, name, _, err := d.resolveName(r.Name)
 	if err != nil {
 		log.Printf("[Mount] ERROR parsing volume: %s", err)
 		return dkvolume.Response{Err: err.Error()}
 	}
 
+	// Serialize operations on this volume
+	defer d.lockVolume(cl, pool, name)()
+
+	// Already mounted on this host
+	mountpoint := d.mountpoint(cl, pool, name)
+	if vol, found := d.getVolume(mountpoint); found {
+		if d.addMountID(vol, r.ID) {
+			log.Printf("[Mount] INFO volume %s is already mounted, sharing it", name)
+		}
+		return dkvolume.Response{Mountpoint: mountpoint}
+	}
+
+	// Choose the mapping mode
+	mode := d.imageMapping(cl, pool, name)
+	m, err := cl.mapperFor(mode)
+	if err != nil {
+		log.Printf("[Mount] ERROR mapping image: %s", err)
+		return dkvolume.Response{Err: err.Error()}
+	}
+
+	// Choose the locking strategy
+	locking := d.imageLocking(cl, pool, name)
+	strategy, err := d.strategyFor(locking)
+	if err != nil {
+		log.Printf("[Mount] ERROR locking image: %s", err)
+		return dkvolume.Response{Err: err.Error()}
+	}
+
+	// Undo the completed steps on failure
+	tx := newTxn("Mount")
+	defer tx.rollback()
+
 	// Add image lock
-	log.Printf("[Mount] INFO locking image %s", name)
-	locker, err := d.lockImage(pool, name, lockID)
+	log.Printf("[Mount] INFO locking image %s with %s", name, locking)
+	var lockID, locker string
+	err = tx.do("unlock image "+name, func() (err error) {
+		lockID, locker, err = strategy.acquire(cl, pool, name, r.ID, d.imageLockWait(cl, pool, name))
+		return err
+	}, func() error {
+		return strategy.release(cl, pool, name, lockID, locker)
+	})
+
 	if err != nil {
 		log.Printf("[Mount] ERROR locking image: %s", err)
 		return dkvolume.Response{Err: err.Error()}
 	}
 
-	// Map the image to a kernel device
-	log.Printf("[Mount] INFO mapping image %s", name)
-	device, err := d.mapImage(pool, name)
+	// The kernel client only supports some features, plus the ones the
+	// locking strategy needs. Only the lock holder may change them.
+	if mode == mappingKRBD {
+		err = tx.do("check features of "+name, func() error {
+			return d.checkFeatures(cl, pool, name, strategy.features())
+		}, nil)
+
+		if err != nil {
+			log.Printf("[Mount] ERROR checking image features: %s", err)
+			return dkvolume.Response{Err: err.Error()}
+		}
+	}
+
+	// The watchers before mapping tell which client is ours
+	var watchers []string
+	if lockID != "" {
+		if watchers, err = cl.rbd.listWatchers(pool, name); err != nil {
+			log.Printf("[Mount] WARN unable to list watchers: %s", err)
+		}
+	}
+
+	// Map the image to a block device
+	log.Printf("[Mount] INFO mapping image %s with %s", name, mode)
+	mapOpts := strategy.mapOpts(false)
+	var device string
+	err = tx.do("unmap image "+name, func() (err error) {
+		device, err = m.mapImage(pool, name, mapOpts)
+		return err
+	}, func() error {
+		return m.unmapImage(device)
+	})
+
 	if err != nil {
-		defer d.unlockImage(pool, name, lockID, locker)
 		log.Printf("[Mount] ERROR mapping image: %s", err)
 		return dkvolume.Response{Err: err.Error()}
 	}
 
+	// Record the client that writes on behalf of the lock
+	if lockID != "" && watchers != nil {
+		err = tx.do("forget the client of "+name, func() error {
+			return d.recordClient(cl, pool, name, lockID, watchers)
+		}, func() error {
+			return d.forgetClient(cl, pool, name)
+		})
+
+		if err != nil {
+			log.Printf("[Mount] WARN unable to record the mapping client, its lock cannot be taken over: %s", err)
+		}
+	}
+
 	// Create mountpoint
-	mountpoint := filepath.Join(d.volRoot, pool, name)
 	log.Printf("[Mount] INFO creating %s", mountpoint)
 	err = os.MkdirAll(mountpoint, os.ModeDir|os.FileMode(int(0775)))
 	if err != nil {
-		defer d.unmapImage(device)
-		defer d.unlockImage(pool, name, lockID, locker)
 		log.Printf("[Mount] ERROR creating mount point: %s", err)
 		return dkvolume.Response{Err: err.Error()}
 	}
 
+	// Read the mount settings stored with the image
+	fstype, mntOpts := d.imageMountOpts(cl, pool, name)
+
+	// Detect the file system actually on the device
+	log.Printf("[Mount] INFO probing device %s", device)
+	detected, _, err := d.host.probeDevice(device)
+	if err == nil && detected == "" {
+		err = errors.New("No file system found on " + device)
+	}
+
+	if err != nil {
+		log.Printf("[Mount] ERROR probing device: %s", err)
+		return dkvolume.Response{Err: err.Error()}
+	}
+
+	if fstype != "" && fstype != detected {
+		log.Printf("[Mount] WARN image metadata says %s but device has %s", fstype, detected)
+	}
+	fstype = detected
+
+	// A read-only device needs a read-only mount
+	if mapOpts.readOnly {
+		mntOpts = strings.TrimSuffix("ro,"+mntOpts, ",")
+	}
+
 	// Mount the device
 	log.Printf("[Mount] INFO mounting device %s", device)
-	if err = d.mountDevice(device, mountpoint, d.defFsType); err != nil {
-		defer d.unmapImage(device)
-		defer d.unlockImage(pool, name, lockID, locker)
+	if err = d.host.mountDevice(device, mountpoint, fstype, mntOpts); err != nil {
 		log.Printf("[Mount] ERROR mounting device: %s", err)
 		return dkvolume.Response{Err: err.Error()}
 	}
 
-	// Add to list of volumes
-	d.volumes[mountpoint] = &volume{
-		name:   name,
-		device: device,
-		locker: locker,
-		fstype: d.defFsType,
-		pool:   pool,
+	tx.commit()
+
+	vol := &volume{
+		name:    name,
+		device:  device,
+		lockID:  lockID,
+		locker:  locker,
+		fstype:  fstype,
+		pool:    pool,
+		cluster: cl.name,
+		mapping: mode,
+		locking: locking,
+		ids:     map[string]struct{}{r.ID: {}},
 	}
 
+	// Start the lease, the renewals retry on failure
+	if d.leaseTTL > 0 && lockID != "" {
+		if err = d.renewLease(cl, vol); err != nil {
+			log.Printf("[Mount] WARN unable to start the lease: %s", err)
+		}
+	}
+
+	// Add to list of volumes
+	d.putVolume(mountpoint, vol)
+
 	return dkvolume.Response{Mountpoint: mountpoint}
 }
 
@@ -302,7 +770,8 @@ func (d *rbdDriver) Mount(r dkvolume.Request) dkvolume.Response {
 // Request:
 //
 //  {
-//     "Name": "volume_name"
+//     "Name": "volume_name",
+//     "ID": "b87d7442095999a92b65b3d9691e697b61713829cc0ffd1bb72e4ccd51aa4d6c"
 //  }
 //
 //  Indication that Docker no longer is using the named volume. This is called
@@ -318,47 +787,52 @@ func (d *rbdDriver) Mount(r dkvolume.Request) dkvolume.Response {
 //  Respond with a string error if an error occurred.
 //-----------------------------------------------------------------------------
 
-func (d *rbdDriver) Unmount(r dkvolume.Request) dkvolume.Response {
+func (d *rbdDriver) Unmount(r dkvolume.UnmountRequest) dkvolume.Response {
+
+	// Refuse new requests while shutting down
+	if err := d.enter(); err != nil {
+		log.Printf("[Unmount] ERROR %s", err)
+		return dkvolume.Response{Err: err.Error()}
+	}
+	defer d.leave()
 
 	// Parse the docker --volume option
-	pool, name, _, err := d.parsePoolNameSize(r.Name)
+	cl, pool, name, _, err := d.resolveName(r.Name)
 	if err != nil {
 		log.Printf("[Unmount] ERROR parsing volume: %s", err)
 		return dkvolume.Response{Err: err.Error()}
 	}
 
+	// Serialize operations on this volume
+	defer d.lockVolume(cl, pool, name)()
+
 	// Retrieve volume state
-	mountpoint := filepath.Join(d.volRoot, pool, name)
-	vol, found := d.volumes[mountpoint]
+	mountpoint := d.mountpoint(cl, pool, name)
+	vol, found := d.getVolume(mountpoint)
 	if !found {
 		err = errors.New("No state found")
 		log.Printf("[Unmount] ERROR retrieving state: %s", err)
 		return dkvolume.Response{Err: err.Error()}
 	}
 
-	// Unmount the device
-	log.Printf("[Unmount] INFO unmounting device %s", vol.device)
-	if err := d.unmountDevice(vol.device); err != nil {
-		log.Printf("[Unmount] ERROR unmounting device: %s", err)
-		return dkvolume.Response{Err: err.Error()}
+	// Forget the caller
+	remaining, known := d.delMountID(vol, r.ID)
+	if !known {
+		log.Printf("[Unmount] WARN unknown mount ID %s for volume %s", r.ID, name)
+		return dkvolume.Response{}
 	}
 
-	// Unmap the image
-	log.Printf("[Unmount] INFO unmapping image %s", name)
-	if err = d.unmapImage(vol.device); err != nil {
-		log.Printf("[Unmount] ERROR unmapping image: %s", err)
-		return dkvolume.Response{Err: err.Error()}
+	// Still in use by other containers
+	if remaining > 0 {
+		log.Printf("[Unmount] INFO volume %s is still used by %d mounts", name, remaining)
+		return dkvolume.Response{}
 	}
 
-	// Unlock the image
-	log.Printf("[Unmount] INFO unlocking image %s", name)
-	if err = d.unlockImage(vol.pool, vol.name, lockID, vol.locker); err != nil {
-		log.Printf("[Unmount] ERROR unlocking image: %s", err)
+	// Unmount, unmap and unlock
+	if err = d.releaseVolume("Unmount", cl, mountpoint, vol); err != nil {
 		return dkvolume.Response{Err: err.Error()}
 	}
 
-	// Forget the volume
-	delete(d.volumes, mountpoint)
 	return dkvolume.Response{}
 }
 
@@ -379,6 +853,7 @@ func (d *rbdDriver) Unmount(r dkvolume.Request) dkvolume.Response {
 //     "Volume": {
 //       "Name": "volume_name",
 //       "Mountpoint": "/path/to/directory/on/host",
+//       "Status": {}
 //     },
 //     "Err": ""
 //  }
@@ -387,7 +862,118 @@ func (d *rbdDriver) Unmount(r dkvolume.Request) dkvolume.Response {
 //-----------------------------------------------------------------------------
 
 func (d *rbdDriver) Get(r dkvolume.Request) dkvolume.Response {
-	return dkvolume.Response{}
+
+	// Refuse new requests while shutting down
+	if err := d.enter(); err != nil {
+		log.Printf("[Get] ERROR %s", err)
+		return dkvolume.Response{Err: err.Error()}
+	}
+	defer d.leave()
+
+	// Parse the docker --volume option
+	cl, pool, name, _, err := d.resolveName(r.Name)
+	if err != nil {
+		log.Printf("[Get] ERROR parsing volume: %s", err)
+		return dkvolume.Response{Err: err.Error()}
+	}
+
+	// Only reads, so no volume lock: a Mount may hold it while it waits for
+	// a busy image, and docker volume inspect must not wait as long.
+
+	// Check if the image exists
+	if exists, err := d.imageExists(cl, pool, name); !exists && err == nil {
+		err = errors.New("Image does not exist: " + cl.name + "/" + pool + "/" + name)
+		log.Printf("[Get] ERROR getting volume: %s", err)
+		return dkvolume.Response{Err: err.Error()}
+	} else if err != nil {
+		log.Printf("[Get] ERROR checking for RBD Image: %s", err)
+		return dkvolume.Response{Err: err.Error()}
+	}
+
+	// Retrieve the image details
+	info, err := cl.rbd.infoImage(pool, name)
+	if err != nil {
+		log.Printf("[Get] ERROR retrieving image info: %s", err)
+		return dkvolume.Response{Err: err.Error()}
+	}
+
+	// Retrieve the image lockers
+	locks, err := d.imageLocks(cl, pool, name)
+	if err != nil {
+		log.Printf("[Get] ERROR listing locks: %s", err)
+		return dkvolume.Response{Err: err.Error()}
+	}
+
+	// The snapshots are informative, a failure is not fatal
+	snaps, err := cl.rbd.listSnapshots(pool, name)
+	if err != nil {
+		log.Printf("[Get] WARN listing snapshots: %s", err)
+	}
+
+	// The usage needs a full scan without fast-diff, skip it then
+	used := ""
+	for _, f := range info.features {
+		if f != "fast-diff" {
+			continue
+		}
+		if bytes, err := cl.rbd.usageImage(pool, name); err != nil {
+			log.Printf("[Get] WARN retrieving image usage: %s", err)
+		} else {
+			used = strconv.FormatUint(bytes>>20, 10) + " MB"
+		}
+	}
+
+	// Read the mount settings stored with the image
+	fstype, mntOpts := d.imageMountOpts(cl, pool, name)
+
+	// Defaults for a volume not mounted on this host
+	mountpoint := d.mountpoint(cl, pool, name)
+	status := map[string]interface{}{
+		"cluster":   cl.name,
+		"pool":      pool,
+		"size":      strconv.FormatUint(info.size>>20, 10) + " MB",
+		"used":      used,
+		"snapshots": strings.Join(snaps, ","),
+		"features":  strings.Join(info.features, ","),
+		"fstype":    fstype,
+		"mntopts":   mntOpts,
+		"mapping":   d.imageMapping(cl, pool, name),
+		"locking":   d.imageLocking(cl, pool, name),
+		"device":    "",
+		"locker":    "",
+		"holder":    holders(locks),
+		"mounted":   false,
+		"mounts":    0,
+	}
+
+	if len(locks) > 0 {
+		status["locker"] = locks[0].locker
+	}
+
+	// The lease as seen by every host
+	if l, found := d.imageLease(cl, pool, name); found {
+		status["lease"] = map[string]interface{}{
+			"holder":  l.lockID,
+			"expires": l.expiry.UTC().Format(time.RFC3339),
+			"expired": !l.expiry.After(time.Now()),
+		}
+	}
+
+	// Overwrite with the local state
+	if vol, found := d.getVolume(mountpoint); found {
+		for k, v := range d.volumeStatus(vol) {
+			status[k] = v
+		}
+		if d.leaseTTL > 0 {
+			status["renewal"] = d.leaseStatus(vol)
+		}
+	}
+
+	return dkvolume.Response{Volume: &dkvolume.Volume{
+		Name:       r.Name,
+		Mountpoint: mountpoint,
+		Status:     status,
+	}}
 }
 
 //-----------------------------------------------------------------------------
@@ -415,57 +1001,301 @@ func (d *rbdDriver) Get(r dkvolume.Request) dkvolume.Response {
 //-----------------------------------------------------------------------------
 
 func (d *rbdDriver) List(r dkvolume.Request) dkvolume.Response {
-	return dkvolume.Response{}
+
+	// Refuse new requests while shutting down
+	if err := d.enter(); err != nil {
+		log.Printf("[List] ERROR %s", err)
+		return dkvolume.Response{Err: err.Error()}
+	}
+	defer d.leave()
+
+	// An image seen in a managed pool
+	type listed struct {
+		cl      *cluster
+		pool    string
+		image   string
+		mounted bool
+	}
+
+	// The image each bare name resolves to, as in resolveName
+	entries := []listed{}
+	resolves := map[string]int{}
+
+	// For each managed pool of each cluster
+	for _, cl := range d.clusterList() {
+		for _, pool := range cl.pools {
+
+			// List RBD images, skipping unreachable pools
+			images, err := cl.rbd.listImages(pool)
+			if err != nil {
+				log.Printf("[List] ERROR listing pool %s in cluster %s: %s", pool, cl.name, err)
+				continue
+			}
+
+			for _, image := range images {
+
+				// Skip renamed images
+				if strings.HasPrefix(image, tombstone) {
+					continue
+				}
+
+				_, mounted := d.getVolume(d.mountpoint(cl, pool, image))
+
+				// Mounted images first, then the first pool holding one
+				if i, found := resolves[image]; !found || (mounted && !entries[i].mounted) {
+					resolves[image] = len(entries)
+				}
+
+				entries = append(entries, listed{cl: cl, pool: pool, image: image, mounted: mounted})
+			}
+		}
+	}
+
+	volumes := []*dkvolume.Volume{}
+
+	for i, e := range entries {
+
+		// Skip images not created by this driver
+		if d.ownedOnly {
+			if owner, err := e.cl.rbd.getImageMeta(e.pool, e.image, metaOwner); err != nil || owner != id {
+				continue
+			}
+		}
+
+		// Only mounted volumes have a mountpoint
+		mountpoint := ""
+		if e.mounted {
+			mountpoint = d.mountpoint(e.cl, e.pool, e.image)
+		}
+
+		// Who holds the volume, if anyone
+		holder := ""
+		if locks, err := d.imageLocks(e.cl, e.pool, e.image); err == nil {
+			holder = holders(locks)
+		}
+
+		// The bare name if it resolves to this image, else a qualified one
+		name := e.image
+		if resolves[e.image] != i {
+			if name = d.volumeName(e.cl, e.pool, e.image); name == e.image {
+				name = e.pool + "/" + e.image
+			}
+		}
+
+		volumes = append(volumes, &dkvolume.Volume{
+			Name:       name,
+			Mountpoint: mountpoint,
+			Status:     map[string]interface{}{"cluster": e.cl.name, "pool": e.pool, "holder": holder},
+		})
+	}
+
+	return dkvolume.Response{Volumes: volumes}
+}
+
+//-----------------------------------------------------------------------------
+// /VolumeDriver.Capabilities
+//
+// Request:
+//
+//  {}
+//
+//  Get the list of capabilities the driver supports.
+//
+// Response:
+//
+//  {
+//     "Capabilities": {
+//       "Scope": "local"
+//     }
+//  }
+//-----------------------------------------------------------------------------
+
+func (d *rbdDriver) Capabilities(r dkvolume.Request) dkvolume.Response {
+	return dkvolume.Response{Capabilities: dkvolume.Capability{Scope: "local"}}
 }
 
 //-----------------------------------------------------------------------------
-// parsePoolNameSize
+// parseName parses [[cluster/]pool/]name[@size]
 //-----------------------------------------------------------------------------
 
-func (d *rbdDriver) parsePoolNameSize(src string) (string, string, int, error) {
+func (d *rbdDriver) parseName(src string) (*cluster, string, string, int, error) {
 
 	sub := nameRegex.FindStringSubmatch(src)
 
-	if len(sub) != 6 {
-		return "", "", 0, errors.New("Unable to parse docker --volume option: %s" + src)
+	if len(sub) != 8 {
+		return nil, "", "", 0, errors.New("Unable to parse docker --volume option: " + src)
 	}
 
 	// Set defaults
-	pool := d.defPool
-	name := sub[3]
+	cl := d.clusters[d.defCluster]
+	name := sub[5]
 	size := d.defSize
 
+	// Cluster overwrite
+	if sub[3] != "" {
+		var found bool
+		if cl, found = d.clusters[sub[3]]; !found {
+			return nil, "", "", 0, errors.New("Unknown cluster: " + sub[3])
+		}
+	}
+
 	// Pool overwrite
-	if sub[2] != "" {
-		pool = sub[2]
+	pool := cl.defPool
+	if sub[4] != "" {
+		pool = sub[4]
 	}
 
 	// Size overwrite
-	if sub[5] != "" {
+	if sub[7] != "" {
 		var err error
-		size, err = strconv.Atoi(sub[5])
+		size, err = strconv.Atoi(sub[7])
 		if err != nil {
 			size = d.defSize
 		}
 	}
 
-	return pool, name, size, nil
+	return cl, pool, name, size, nil
+}
+
+//-----------------------------------------------------------------------------
+// resolveName is like parseName but, when the volume name has no pool, it
+// searches for the image in all the managed pools of all the clusters.
+//-----------------------------------------------------------------------------
+
+func (d *rbdDriver) resolveName(src string) (*cluster, string, string, int, error) {
+
+	// Parse the docker --volume option
+	cl, pool, name, size, err := d.parseName(src)
+	if err != nil || strings.Contains(src, "/") {
+		return cl, pool, name, size, err
+	}
+
+	// Search the known mounts
+	for _, c := range d.clusterList() {
+		for _, p := range c.pools {
+			if _, found := d.getVolume(d.mountpoint(c, p, name)); found {
+				return c, p, name, size, nil
+			}
+		}
+	}
+
+	// Search the managed pools
+	for _, c := range d.clusterList() {
+		for _, p := range c.pools {
+			exists, err := d.imageExists(c, p, name)
+			if err != nil {
+				return nil, "", "", 0, err
+			}
+			if exists {
+				return c, p, name, size, nil
+			}
+		}
+	}
+
+	return cl, pool, name, size, nil
+}
+
+//-----------------------------------------------------------------------------
+// imageMountOpts returns the file system type and mount options stored with
+// the image. An empty file system type means it must be detected.
+//-----------------------------------------------------------------------------
+
+func (d *rbdDriver) imageMountOpts(cl *cluster, pool, name string) (string, string) {
+
+	// Missing keys are not an error
+	fstype, _ := cl.rbd.getImageMeta(pool, name, metaFsType)
+	mntOpts, _ := cl.rbd.getImageMeta(pool, name, metaMntOpts)
+
+	return fstype, mntOpts
+}
+
+//-----------------------------------------------------------------------------
+// imageMapping returns the mapping mode stored with the image or the default.
+//-----------------------------------------------------------------------------
+
+func (d *rbdDriver) imageMapping(cl *cluster, pool, name string) string {
+
+	if mode, err := cl.rbd.getImageMeta(pool, name, metaMapping); err == nil && mode != "" {
+		return mode
+	}
+
+	return d.defMapping
+}
+
+//-----------------------------------------------------------------------------
+// imageLockWait returns how long Mount waits for a busy lock, as stored with
+// the image or the default.
+//-----------------------------------------------------------------------------
+
+func (d *rbdDriver) imageLockWait(cl *cluster, pool, name string) time.Duration {
+
+	if value, err := cl.rbd.getImageMeta(pool, name, metaLockWait); err == nil && value != "" {
+		if wait, err := time.ParseDuration(value); err == nil {
+			return wait
+		}
+		log.Printf("[Lock] WARN ignoring invalid lock wait %s of %s/%s/%s", value, cl.name, pool, name)
+	}
+
+	return d.lockWait
+}
+
+//-----------------------------------------------------------------------------
+// checkFeatures compares the image features with the ones supported by krbd
+// and the required ones and, if allowed, disables the unsupported ones. An
+// empty supported set disables the check.
+//-----------------------------------------------------------------------------
+
+func (d *rbdDriver) checkFeatures(cl *cluster, pool, name string, required []string) error {
+
+	// Nothing to compare with
+	if len(d.features) == 0 {
+		return nil
+	}
+
+	// Read the image features
+	info, err := cl.rbd.infoImage(pool, name)
+	if err != nil {
+		return err
+	}
+
+	supported := map[string]bool{}
+	for _, f := range append(append([]string{}, d.features...), required...) {
+		supported[f] = true
+	}
+
+	unsupported := []string{}
+	for _, f := range info.features {
+		if !supported[f] {
+			unsupported = append(unsupported, f)
+		}
+	}
+
+	if len(unsupported) == 0 {
+		return nil
+	}
+
+	// Refuse unless the policy allows changing the image
+	if !d.fixFeat {
+		return errors.New("Image features not supported by krbd: " + strings.Join(unsupported, ", "))
+	}
+
+	log.Printf("[Features] WARN disabling %s on %s/%s", strings.Join(unsupported, ", "), pool, name)
+	return cl.rbd.disableFeatures(pool, name, unsupported)
 }
 
 //-----------------------------------------------------------------------------
 // imageExists
 //-----------------------------------------------------------------------------
 
-func (d *rbdDriver) imageExists(pool, name string) (bool, error) {
+func (d *rbdDriver) imageExists(cl *cluster, pool, name string) (bool, error) {
 
 	// List RBD images
-	out, err := exec.Command(d.cmd["rbd"], "ls", pool).Output()
+	list, err := cl.rbd.listImages(pool)
 	if err != nil {
-		return false, errors.New("Unable to list images")
+		return false, err
 	}
 
-	// Parse the output
-	list := strings.Split(string(out), "\n")
+	// Search for the image
 	for _, item := range list {
 		if item == name {
 			return true, nil
@@ -479,201 +1309,316 @@ func (d *rbdDriver) imageExists(pool, name string) (bool, error) {
 // createImage
 //-----------------------------------------------------------------------------
 
-func (d *rbdDriver) createImage(pool, name, fstype string, size int) error {
+func (d *rbdDriver) createImage(cl *cluster, pool, name string, opts *imageOpts) error {
+
+	// The locking strategy may need some features
+	strategy, err := d.strategyFor(opts.locking)
+	if err != nil {
+		return err
+	}
+
+	// Images for the kernel client get only the supported features, or the
+	// cluster defaults if the supported set is not given
+	features := []string{}
+	if opts.mapping == mappingKRBD && len(d.features) > 0 {
+		have := map[string]bool{}
+		for _, f := range append(append([]string{}, d.features...), strategy.features()...) {
+			if !have[f] {
+				features = append(features, f)
+				have[f] = true
+			}
+		}
+	}
+
+	// Undo the completed steps on failure
+	tx := newTxn("Create")
+	defer tx.rollback()
 
 	// Create the image device
-	err := exec.Command(
-		d.cmd["rbd"], "create",
-		"--pool", pool,
-		"--size", strconv.Itoa(size),
-		name,
-	).Run()
+	err = tx.do("remove image "+name, func() error {
+		return cl.rbd.createImage(pool, name, opts.size, features)
+	}, func() error {
+		return cl.rbd.removeImage(pool, name)
+	})
 
 	if err != nil {
-		return errors.New("Unable to create the image device")
+		return err
 	}
 
-	// Add image lock
-	locker, err := d.lockImage(pool, name, lockID)
+	// Persist the options with the image
+	meta := [][2]string{
+		{metaOwner, id},
+		{metaFsType, opts.fstype},
+		{metaMkfs, opts.mkfsOpts},
+		{metaMntOpts, opts.mntOpts},
+		{metaSize, strconv.Itoa(opts.size)},
+		{metaCreated, time.Now().UTC().Format(time.RFC3339)},
+		{metaMapping, opts.mapping},
+		{metaLockWait, opts.lockWait},
+		{metaLocking, opts.locking},
+	}
+
+	for _, kv := range meta {
+		if err = cl.rbd.setImageMeta(pool, name, kv[0], kv[1]); err != nil {
+			return err
+		}
+	}
+
+	// The mapper to format the image
+	m, err := cl.mapperFor(opts.mapping)
 	if err != nil {
 		return err
 	}
 
-	// Map the image to a kernel device
-	device, err := d.mapImage(pool, name)
+	// Add image lock
+	var lockID, locker string
+	err = tx.do("unlock image "+name, func() (err error) {
+		lockID, locker, err = strategy.acquire(cl, pool, name, "create", 0)
+		return err
+	}, func() error {
+		return strategy.release(cl, pool, name, lockID, locker)
+	})
+
 	if err != nil {
-		defer d.unlockImage(pool, name, lockID, locker)
 		return err
 	}
 
-	// Make the filesystem
-	if err = d.makeFs(device, d.defFsType); err != nil {
-		defer d.unmapImage(device)
-		defer d.unlockImage(pool, name, lockID, locker)
+	// Map the image to a block device
+	var device string
+	err = tx.do("unmap image "+name, func() (err error) {
+		device, err = m.mapImage(pool, name, strategy.mapOpts(true))
+		return err
+	}, func() error {
+		return m.unmapImage(device)
+	})
+
+	if err != nil {
 		return err
 	}
 
-	// Unmap the image from kernel device
-	if err = d.unmapImage(device); err != nil {
+	// Never format a device holding data unless forced
+	fstype, pttype, err := d.host.probeDevice(device)
+	if err == nil && !opts.forceFormat {
+		if fstype != "" {
+			err = errors.New("Device " + device + " already contains a " + fstype + " file system")
+		} else if pttype != "" {
+			err = errors.New("Device " + device + " already contains a " + pttype + " partition table")
+		}
+	}
+
+	if err != nil {
 		return err
 	}
 
-	// Remove image lock
-	if err = d.unlockImage(pool, name, lockID, locker); err != nil {
+	// Make the filesystem
+	if err = d.host.makeFs(device, opts.fstype, opts.mkfsOpts); err != nil {
 		return err
 	}
 
-	return nil
+	// Unmap and unlock, keeping the image
+	tx.forget("remove image " + name)
+	return tx.finish()
 }
 
 //-----------------------------------------------------------------------------
-// lockImage
+// takeoverLock removes the lock if none of its clients watches the image and
+// either its lease expired or, for holders without a lease, none has watched
+// it for the whole grace period. The clients are blocklisted first so that
+// they cannot write to the image if they come back. Locks of this host and
+// locks whose mapping client is unknown are never taken over.
 //-----------------------------------------------------------------------------
 
-func (d *rbdDriver) lockImage(pool, name, lockID string) (string, error) {
-
-	// Lock the image
-	err := exec.Command(
-		d.cmd["rbd"], "lock",
-		"add", "--pool", pool,
-		name, lockID,
-	).Run()
+func (d *rbdDriver) takeoverLock(cl *cluster, pool, name string) error {
 
-	if err != nil {
-		return "", errors.New("Unable to lock the image")
+	// The holders of our locks
+	held := func() ([]lockHolder, error) {
+		locks, err := d.imageLocks(cl, pool, name)
+		if err == nil && len(locks) == 0 {
+			err = errors.New("Lock is gone")
+		}
+		return locks, err
 	}
 
-	// List the locks
-	out, err := exec.Command(
-		d.cmd["rbd"], "lock", "list",
-		"--pool", pool, name,
-	).Output()
+	// Whether a client of the holders still watches the image
+	alive := func(clients []string) (string, error) {
+		watchers, err := cl.rbd.listWatchers(pool, name)
+		if err != nil {
+			return "", err
+		}
+		for _, c := range clients {
+			for _, w := range watchers {
+				if w == c {
+					return c, nil
+				}
+			}
+		}
+		return "", nil
+	}
 
+	before, err := held()
 	if err != nil {
-		return "", errors.New("Unable to list the image locks")
+		return err
 	}
 
-	// Parse the locker ID
-	lines := strings.Split(string(out), "\n")
-	if len(lines) > 1 {
-		for _, line := range lines[1:] {
-			sub := lockRegex.FindStringSubmatch(line)
-			if len(sub) == 2 {
-				return sub[1], nil
-			}
-		}
+	clients, err := d.lockClients(cl, pool, name, before)
+	if err != nil {
+		return err
 	}
 
-	return "", errors.New("Unable to parse locker ID")
-}
+	// A valid lease means the holder is alive
+	l, leased := d.imageLease(cl, pool, name)
+	leased = leased && l.lockID == before[0].id
+	if leased && l.expiry.After(time.Now()) {
+		return errors.New("Holder " + before[0].String() + " has a lease until " + l.expiry.UTC().Format(time.RFC3339))
+	}
 
-//-----------------------------------------------------------------------------
-// unlockImage
-//-----------------------------------------------------------------------------
+	// Its clients must be gone anyway, a stopped plugin stops renewing
+	if client, err := alive(clients); err != nil {
+		return err
+	} else if client != "" {
+		return errors.New("Holder client " + client + " is alive")
+	}
 
-func (d *rbdDriver) unlockImage(pool, name, lockID, locker string) error {
+	// An expired lease spares the grace period
+	if leased {
+		log.Printf("[Lock] WARN %s/%s/%s lease expired at %s and it has no watchers", cl.name, pool, name, l.expiry.UTC().Format(time.RFC3339))
+		return d.fenceLocks(cl, pool, name, before, clients)
+	}
 
-	// Unlock the image
-	err := exec.Command(
-		d.cmd["rbd"], "lock", "remove",
-		name, lockID, locker,
-	).Run()
+	// Check again after the grace period
+	log.Printf("[Lock] WARN %s/%s/%s has neither lease nor watchers, waiting %s before taking it over", cl.name, pool, name, d.grace)
+	time.Sleep(d.grace)
 
+	after, err := held()
 	if err != nil {
-		return errors.New("Unable to unlock the image")
+		return err
 	}
 
-	return nil
-}
-
-//-----------------------------------------------------------------------------
-// mapImage
-//-----------------------------------------------------------------------------
-
-func (d *rbdDriver) mapImage(pool, name string) (string, error) {
-
-	// Map the image to a kernel device
-	out, err := exec.Command(
-		d.cmd["rbd"], "map",
-		"--pool", pool, name,
-	).Output()
+	if len(after) != len(before) || after[0] != before[0] {
+		return errors.New("Lock changed hands during the grace period")
+	}
 
-	if err != nil {
-		return "", errors.New("Unable to map the image to a kernel device")
+	if client, err := alive(clients); err != nil {
+		return err
+	} else if client != "" {
+		return errors.New("Holder client " + client + " is alive")
 	}
 
-	// Parse the device
-	return strings.TrimSpace(string(out)), nil
+	return d.fenceLocks(cl, pool, name, after, clients)
 }
 
 //-----------------------------------------------------------------------------
-// unmapImage
+// fenceLocks blocklists the exact client addresses of the stale locks and
+// removes the locks.
 //-----------------------------------------------------------------------------
 
-func (d *rbdDriver) unmapImage(device string) error {
+func (d *rbdDriver) fenceLocks(cl *cluster, pool, name string, locks []lockHolder, clients []string) error {
 
-	// Unmap the image from a kernel device
-	err := exec.Command(
-		d.cmd["rbd"], "unmap", device,
-	).Run()
+	for _, c := range clients {
+		log.Printf("[Lock] WARN TAKEOVER %s/%s/%s: fencing client %s of %s", cl.name, pool, name, c, holders(locks))
+		if err := cl.rbd.blocklistClient(c); err != nil {
+			return err
+		}
+	}
 
-	if err != nil {
-		return errors.New("Unable to unmap the image from " + device)
+	for _, h := range locks {
+
+		if err := cl.rbd.unlockImage(pool, name, h.id, h.locker); err != nil {
+			return err
+		}
+
+		log.Printf("[Lock] WARN TAKEOVER %s/%s/%s: removed the lock of %s", cl.name, pool, name, h)
 	}
 
 	return nil
 }
 
 //-----------------------------------------------------------------------------
-// makeFs
+// lockImage takes a lock whose ID names this host, plugin instance and caller.
+// A busy lock is retried until it is released or the wait is over. It returns
+// the lock ID and the locker.
 //-----------------------------------------------------------------------------
 
-func (d *rbdDriver) makeFs(device, fsType string) error {
+func (d *rbdDriver) lockImage(cl *cluster, pool, name, caller string, wait time.Duration) (string, string, error) {
 
-	// Search for mkfs
-	mkfs, err := exec.LookPath("mkfs." + d.defFsType)
-	if err != nil {
-		return errors.New("Unable to find mkfs." + d.defFsType)
-	}
+	lockID := d.lockID(caller)
+	deadline := time.Now().Add(wait)
 
-	// Make the file system
-	if err = exec.Command(mkfs, device).Run(); err != nil {
-		return errors.New("Unable to make file system on " + device)
-	}
+	for {
 
-	return nil
-}
+		// Lock the image, naming the holder if it is taken
+		err := cl.rbd.lockImage(pool, name, lockID)
+		if err == nil {
+			break
+		}
 
-//-----------------------------------------------------------------------------
-// mountDevice
-//-----------------------------------------------------------------------------
+		e, ok := err.(*cmdError)
+		if !ok || e.kind != errLocked {
+			return "", "", err
+		}
 
-func (d *rbdDriver) mountDevice(device, mountpoint, fsType string) error {
+		if locks, _ := d.imageLocks(cl, pool, name); len(locks) > 0 {
+			e.holder = holders(locks)
+		}
 
-	// Mount the device
-	err := exec.Command(
-		d.cmd["mount"],
-		"-t", fsType,
-		device, mountpoint,
-	).Run()
+		// Take the lock over if its holder is dead
+		if d.takeover {
+			terr := d.takeoverLock(cl, pool, name)
+			if terr == nil {
+				continue
+			}
+			log.Printf("[Lock] INFO not taking over %s/%s/%s: %s", cl.name, pool, name, terr)
+		}
 
-	if err != nil {
-		return errors.New("Unable to mount " + device + "on " + mountpoint)
+		// Wait for the holder to release it
+		left := deadline.Sub(time.Now())
+		if left <= 0 {
+			if wait > 0 {
+				e.op += " after waiting " + wait.String()
+			}
+			return "", "", err
+		}
+
+		log.Printf("[Lock] INFO %s/%s/%s is locked by %s, waiting up to %s", cl.name, pool, name, e.holder, left.Round(time.Second))
+		if left > lockPoll {
+			left = lockPoll
+		}
+		time.Sleep(left)
 	}
 
-	return nil
+	// Return the locker ID
+	locker, err := d.lockerOf(cl, pool, name, lockID)
+	if err == nil {
+		return lockID, locker, nil
+	}
+
+	// Give the lock back, removing it needs the locker
+	if locker, lerr := d.lockerOf(cl, pool, name, lockID); lerr != nil {
+		log.Printf("[Lock] ERROR unable to remove lock %s of %s/%s/%s, it must be removed by hand: %s", lockID, cl.name, pool, name, lerr)
+	} else if uerr := cl.rbd.unlockImage(pool, name, lockID, locker); uerr != nil {
+		log.Printf("[Lock] ERROR unable to remove lock %s of %s/%s/%s, it must be removed by hand: %s", lockID, cl.name, pool, name, uerr)
+	}
+
+	return "", "", err
 }
 
 //-----------------------------------------------------------------------------
-// unmountDevice
+// lockerOf returns the locker of a lock of the image.
 //-----------------------------------------------------------------------------
 
-func (d *rbdDriver) unmountDevice(device string) error {
+func (d *rbdDriver) lockerOf(cl *cluster, pool, name, lockID string) (string, error) {
+
+	// List the locks
+	locks, err := cl.rbd.listLocks(pool, name)
+	if err != nil {
+		return "", err
+	}
 
-	// Unmount the device
-	if err := exec.Command(d.cmd["umount"], device).Run(); err != nil {
-		return errors.New("Unable to umount " + device)
+	for _, l := range locks {
+		if l.id == lockID {
+			return l.locker, nil
+		}
 	}
 
-	return nil
+	return "", errors.New("Unable to parse locker ID")
 }
@@ -0,0 +1,640 @@
+//-----------------------------------------------------------------------------
+// Package membership:
+//-----------------------------------------------------------------------------
+
+package main
+
+//-----------------------------------------------------------------------------
+// Imports:
+//-----------------------------------------------------------------------------
+
+import (
+
+	// Standard library:
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	// Community:
+	dkvolume "github.com/docker/go-plugins-helpers/volume"
+)
+
+//-----------------------------------------------------------------------------
+// TestMain silences the driver log.
+//-----------------------------------------------------------------------------
+
+func TestMain(m *testing.M) {
+	log.SetOutput(ioutil.Discard)
+	os.Exit(m.Run())
+}
+
+//-----------------------------------------------------------------------------
+// TestCreate
+//-----------------------------------------------------------------------------
+
+func TestCreate(t *testing.T) {
+
+	d, f := newTestDriver(t)
+
+	r := d.Create(dkvolume.Request{Name: "data", Options: map[string]string{"size": "2G", "mntopts": "noatime"}})
+	if r.Err != "" {
+		t.Fatalf("Create: %s", r.Err)
+	}
+
+	img := f.images["rbd/data"]
+	if img == nil {
+		t.Fatal("Create did not create rbd/data")
+	}
+
+	if img.size != 2048 || img.fstype != "xfs" {
+		t.Errorf("image has size %d and fstype %q, want 2048 and xfs", img.size, img.fstype)
+	}
+
+	for key, want := range map[string]string{metaOwner: id, metaFsType: "xfs", metaMntOpts: "noatime", metaLocking: lockingAdvisory} {
+		if got := img.meta[key]; got != want {
+			t.Errorf("metadata %s is %q, want %q", key, got, want)
+		}
+	}
+
+	// Formatting leaves nothing behind
+	if left := f.leaks(); len(left) > 0 {
+		t.Errorf("Create left %v", left)
+	}
+
+	// A second Create keeps the image
+	img.fstype = "ext4"
+	if r = d.Create(dkvolume.Request{Name: "data"}); r.Err != "" {
+		t.Fatalf("second Create: %s", r.Err)
+	}
+
+	if f.images["rbd/data"].fstype != "ext4" {
+		t.Error("second Create formatted the image again")
+	}
+}
+
+//-----------------------------------------------------------------------------
+// TestCreateInvalid
+//-----------------------------------------------------------------------------
+
+func TestCreateInvalid(t *testing.T) {
+
+	d, f := newTestDriver(t)
+
+	for _, r := range []dkvolume.Request{
+		{Name: "bad name!"},
+		{Name: "data", Options: map[string]string{"size": "lots"}},
+		{Name: "data", Options: map[string]string{"fstype": "x;fs"}},
+		{Name: "data", Options: map[string]string{"locking": "maybe"}},
+		{Name: "data", Options: map[string]string{"pool": "other"}},
+		{Name: "data", Options: map[string]string{"color": "blue"}},
+	} {
+		if resp := d.Create(r); resp.Err == "" {
+			t.Errorf("Create %s %v succeeded", r.Name, r.Options)
+		}
+	}
+
+	if f.hasImage("rbd", "data") {
+		t.Error("invalid Create created an image")
+	}
+}
+
+//-----------------------------------------------------------------------------
+// TestCreateFailure
+//-----------------------------------------------------------------------------
+
+func TestCreateFailure(t *testing.T) {
+
+	d, f := newTestDriver(t)
+	f.fail("list")
+
+	if r := d.Create(dkvolume.Request{Name: "data"}); r.Err == "" {
+		t.Fatal("Create succeeded without listing the pool")
+	}
+
+	if f.hasImage("rbd", "data") {
+		t.Error("Create created an image it could not check")
+	}
+}
+
+//-----------------------------------------------------------------------------
+// TestRemove
+//-----------------------------------------------------------------------------
+
+func TestRemove(t *testing.T) {
+
+	d, f := newTestDriver(t)
+	f.addImage("rbd", "data", "xfs")
+
+	if r := d.Remove(dkvolume.Request{Name: "data"}); r.Err != "" {
+		t.Fatalf("Remove: %s", r.Err)
+	}
+
+	if f.hasImage("rbd", "data") {
+		t.Error("Remove kept the image")
+	}
+
+	// A missing image is already removed
+	if r := d.Remove(dkvolume.Request{Name: "data"}); r.Err != "" {
+		t.Errorf("Remove of a missing image: %s", r.Err)
+	}
+}
+
+//-----------------------------------------------------------------------------
+// TestRemoveRefused
+//-----------------------------------------------------------------------------
+
+func TestRemoveRefused(t *testing.T) {
+
+	d, f := newTestDriver(t)
+	f.addImage("rbd", "mounted", "xfs")
+	f.addImage("rbd", "locked", "xfs")
+	f.addLock("rbd", "locked", "dockerLock:node2:9f8e7d6c:abcdef012345")
+
+	if r := d.Mount(dkvolume.MountRequest{Name: "mounted", ID: "c1"}); r.Err != "" {
+		t.Fatalf("Mount: %s", r.Err)
+	}
+
+	for _, name := range []string{"mounted", "locked"} {
+		if r := d.Remove(dkvolume.Request{Name: name}); r.Err == "" {
+			t.Errorf("Remove of the %s image succeeded", name)
+		}
+		if !f.hasImage("rbd", name) {
+			t.Errorf("Remove deleted the %s image", name)
+		}
+	}
+}
+
+//-----------------------------------------------------------------------------
+// TestRemovePolicies
+//-----------------------------------------------------------------------------
+
+func TestRemovePolicies(t *testing.T) {
+
+	for policy, check := range map[string]func(f *fakeCeph) bool{
+		removeKeep: func(f *fakeCeph) bool { return f.hasImage("rbd", "data") },
+		removeRename: func(f *fakeCeph) bool {
+			images, _ := f.listImages("rbd")
+			return len(images) == 1 && strings.HasPrefix(images[0], tombstone+"data_")
+		},
+	} {
+		d, f := newTestDriver(t)
+		d.remove = policy
+		f.addImage("rbd", "data", "xfs")
+
+		if r := d.Remove(dkvolume.Request{Name: "data"}); r.Err != "" {
+			t.Errorf("Remove with policy %s: %s", policy, r.Err)
+		} else if !check(f) {
+			t.Errorf("Remove with policy %s left %v", policy, f.images)
+		}
+
+		// Renamed images are hidden
+		if r := d.List(dkvolume.Request{}); policy == removeRename && len(r.Volumes) != 0 {
+			t.Errorf("List shows the renamed image: %v", r.Volumes[0].Name)
+		}
+	}
+}
+
+//-----------------------------------------------------------------------------
+// TestPath
+//-----------------------------------------------------------------------------
+
+func TestPath(t *testing.T) {
+
+	d, _ := newTestDriver(t)
+
+	r := d.Path(dkvolume.Request{Name: "data"})
+	if want := filepath.Join(d.volRoot, "ceph", "rbd", "data"); r.Err != "" || r.Mountpoint != want {
+		t.Errorf("Path returned %q (%s), want %q", r.Mountpoint, r.Err, want)
+	}
+
+	if r = d.Path(dkvolume.Request{Name: "nowhere/rbd/data"}); r.Err == "" {
+		t.Error("Path of an unknown cluster succeeded")
+	}
+}
+
+//-----------------------------------------------------------------------------
+// TestMountUnmount
+//-----------------------------------------------------------------------------
+
+func TestMountUnmount(t *testing.T) {
+
+	d, f := newTestDriver(t)
+	f.addImage("rbd", "data", "xfs")
+	mountpoint := filepath.Join(d.volRoot, "ceph", "rbd", "data")
+
+	r := d.Mount(dkvolume.MountRequest{Name: "data", ID: "c1"})
+	if r.Err != "" || r.Mountpoint != mountpoint {
+		t.Fatalf("Mount returned %q (%s), want %q", r.Mountpoint, r.Err, mountpoint)
+	}
+
+	if _, err := os.Stat(mountpoint); err != nil {
+		t.Errorf("Mount did not create the mountpoint: %s", err)
+	}
+
+	vol, found := d.getVolume(mountpoint)
+	if !found {
+		t.Fatal("Mount did not register the volume")
+	}
+
+	img := f.images["rbd/data"]
+	if len(img.locks) != 1 || img.locks[0].id != vol.lockID || !strings.HasPrefix(vol.lockID, "dockerLock:node1:0a1b2c3d:") {
+		t.Errorf("image locks are %v, want the lock %s", img.locks, vol.lockID)
+	}
+
+	if f.mounts[mountpoint] != vol.device {
+		t.Errorf("%s is not mounted on %s", vol.device, mountpoint)
+	}
+
+	// The mapping client is recorded for takeovers
+	if got, want := img.meta[metaClient], vol.lockID+" "+f.clients[vol.device]; got != want {
+		t.Errorf("recorded client is %q, want %q", got, want)
+	}
+
+	// A second container shares the mount
+	if r = d.Mount(dkvolume.MountRequest{Name: "data", ID: "c2"}); r.Err != "" || r.Mountpoint != mountpoint {
+		t.Fatalf("second Mount returned %q (%s)", r.Mountpoint, r.Err)
+	}
+
+	if len(f.devices) != 1 {
+		t.Errorf("second Mount mapped the image again: %v", f.devices)
+	}
+
+	if r := d.Unmount(dkvolume.UnmountRequest{Name: "data", ID: "c1"}); r.Err != "" {
+		t.Fatalf("first Unmount: %s", r.Err)
+	}
+
+	if _, found := f.mounts[mountpoint]; !found {
+		t.Error("first Unmount unmounted a volume still in use")
+	}
+
+	// The last one releases everything
+	if r := d.Unmount(dkvolume.UnmountRequest{Name: "data", ID: "c2"}); r.Err != "" {
+		t.Fatalf("last Unmount: %s", r.Err)
+	}
+
+	if left := f.leaks(); len(left) > 0 {
+		t.Errorf("Unmount left %v", left)
+	}
+
+	if _, found := d.getVolume(mountpoint); found {
+		t.Error("Unmount kept the volume")
+	}
+
+	if _, found := img.meta[metaClient]; found {
+		t.Error("Unmount kept the recorded client")
+	}
+
+	if r := d.Unmount(dkvolume.UnmountRequest{Name: "data", ID: "c2"}); r.Err == "" {
+		t.Error("Unmount of an unmounted volume succeeded")
+	}
+}
+
+//-----------------------------------------------------------------------------
+// TestMountLocked
+//-----------------------------------------------------------------------------
+
+func TestMountLocked(t *testing.T) {
+
+	d, f := newTestDriver(t)
+	f.addImage("rbd", "data", "xfs")
+	f.addLock("rbd", "data", "dockerLock:node2:9f8e7d6c:abcdef012345")
+
+	r := d.Mount(dkvolume.MountRequest{Name: "data", ID: "c1"})
+	if r.Err == "" {
+		t.Fatal("Mount of a locked image succeeded")
+	}
+
+	if !strings.Contains(r.Err, errLocked) || !strings.Contains(r.Err, "@node2") {
+		t.Errorf("Mount error %q does not name the holder", r.Err)
+	}
+
+	if len(f.devices) > 0 || len(f.mounts) > 0 {
+		t.Errorf("Mount of a locked image left %v", f.leaks())
+	}
+}
+
+//-----------------------------------------------------------------------------
+// TestMountFeatures checks that unsupported features are only disabled by the
+// lock holder.
+//-----------------------------------------------------------------------------
+
+func TestMountFeatures(t *testing.T) {
+
+	d, f := newTestDriver(t)
+	d.features = []string{"layering"}
+	d.fixFeat = true
+	img := f.addImage("rbd", "data", "xfs")
+	f.addLock("rbd", "data", "dockerLock:node2:9f8e7d6c:abcdef012345")
+
+	if r := d.Mount(dkvolume.MountRequest{Name: "data", ID: "c1"}); r.Err == "" {
+		t.Fatal("Mount of a locked image succeeded")
+	}
+
+	if len(img.features) != len(fakeDefFeatures) {
+		t.Errorf("Mount changed the features of a locked image to %v", img.features)
+	}
+
+	// Unlocked, the advisory lock needs no feature
+	img.locks = nil
+	if r := d.Mount(dkvolume.MountRequest{Name: "data", ID: "c1"}); r.Err != "" {
+		t.Fatalf("Mount: %s", r.Err)
+	}
+
+	if len(img.features) != 1 || img.features[0] != "layering" {
+		t.Errorf("Mount left the features %v", img.features)
+	}
+
+	// Refused without -fixFeatures, unlocking again
+	d, f = newTestDriver(t)
+	d.features = []string{"layering"}
+	f.addImage("rbd", "data", "xfs")
+
+	if r := d.Mount(dkvolume.MountRequest{Name: "data", ID: "c1"}); r.Err == "" {
+		t.Error("Mount of an image with unsupported features succeeded")
+	}
+
+	if left := f.leaks(); len(left) > 0 {
+		t.Errorf("Mount with unsupported features left %v", left)
+	}
+}
+
+//-----------------------------------------------------------------------------
+// TestMountLockingStrategies
+//-----------------------------------------------------------------------------
+
+func TestMountLockingStrategies(t *testing.T) {
+
+	for _, locking := range []string{lockingExclusive, lockingNone} {
+
+		d, f := newTestDriver(t)
+		img := f.addImage("rbd", "data", "xfs")
+		img.meta[metaLocking] = locking
+
+		r := d.Mount(dkvolume.MountRequest{Name: "data", ID: "c1"})
+		if r.Err != "" {
+			t.Errorf("Mount with %s locking: %s", locking, r.Err)
+			continue
+		}
+
+		if len(img.locks) > 0 {
+			t.Errorf("Mount with %s locking took the lock %v", locking, img.locks)
+		}
+
+		if r = d.Unmount(dkvolume.UnmountRequest{Name: "data", ID: "c1"}); r.Err != "" {
+			t.Errorf("Unmount with %s locking: %s", locking, r.Err)
+		}
+
+		if left := f.leaks(); len(left) > 0 {
+			t.Errorf("Unmount with %s locking left %v", locking, left)
+		}
+	}
+}
+
+//-----------------------------------------------------------------------------
+// TestGet
+//-----------------------------------------------------------------------------
+
+func TestGet(t *testing.T) {
+
+	d, f := newTestDriver(t)
+	img := f.addImage("rbd", "data", "xfs")
+	img.used = 300 << 20
+	img.snaps = []string{"daily", "weekly"}
+
+	if r := d.Mount(dkvolume.MountRequest{Name: "data", ID: "c1"}); r.Err != "" {
+		t.Fatalf("Mount: %s", r.Err)
+	}
+
+	r := d.Get(dkvolume.Request{Name: "data"})
+	if r.Err != "" || r.Volume == nil {
+		t.Fatalf("Get: %s", r.Err)
+	}
+
+	for key, want := range map[string]interface{}{
+		"cluster":   "ceph",
+		"pool":      "rbd",
+		"size":      "1024 MB",
+		"used":      "300 MB",
+		"snapshots": "daily,weekly",
+		"fstype":    "xfs",
+		"locking":   lockingAdvisory,
+		"mounted":   true,
+		"mounts":    1,
+	} {
+		if got := r.Volume.Status[key]; got != want {
+			t.Errorf("status %s is %v, want %v", key, got, want)
+		}
+	}
+
+	if holder, _ := r.Volume.Status["holder"].(string); !strings.Contains(holder, "@node1") {
+		t.Errorf("status holder is %q, want this host", holder)
+	}
+
+	if r = d.Get(dkvolume.Request{Name: "missing"}); r.Err == "" {
+		t.Error("Get of a missing image succeeded")
+	}
+}
+
+//-----------------------------------------------------------------------------
+// TestGetDegraded
+//-----------------------------------------------------------------------------
+
+func TestGetDegraded(t *testing.T) {
+
+	d, f := newTestDriver(t)
+	img := f.addImage("rbd", "data", "xfs")
+	img.features = []string{"layering"}
+	img.used = 300 << 20
+	f.fail("snap")
+
+	r := d.Get(dkvolume.Request{Name: "data"})
+	if r.Err != "" {
+		t.Fatalf("Get without snapshots: %s", r.Err)
+	}
+
+	// No fast-diff means no usage
+	if used := r.Volume.Status["used"]; used != "" {
+		t.Errorf("status used is %v without fast-diff", used)
+	}
+
+	if snaps := r.Volume.Status["snapshots"]; snaps != "" {
+		t.Errorf("status snapshots is %v after a failure", snaps)
+	}
+
+	if r.Volume.Status["mounted"] != false {
+		t.Error("status says an unmounted volume is mounted")
+	}
+}
+
+//-----------------------------------------------------------------------------
+// TestGetDuringLockWait checks that Get answers while a Mount of the volume
+// waits for a busy lock.
+//-----------------------------------------------------------------------------
+
+func TestGetDuringLockWait(t *testing.T) {
+
+	d, f := newTestDriver(t)
+	d.lockWait = 3 * time.Second
+	f.addImage("rbd", "data", "xfs")
+	f.addLock("rbd", "data", staleID)
+
+	mounted := make(chan dkvolume.Response, 1)
+	go func() { mounted <- d.Mount(dkvolume.MountRequest{Name: "data", ID: "c1"}) }()
+
+	// Mount is waiting once its first lock attempt failed
+	for tried := false; !tried; {
+		time.Sleep(time.Millisecond)
+		f.mutex.Lock()
+		tried = f.calls["lock"] > 0
+		f.mutex.Unlock()
+	}
+
+	got := make(chan dkvolume.Response, 1)
+	go func() { got <- d.Get(dkvolume.Request{Name: "data"}) }()
+
+	select {
+	case r := <-got:
+		if r.Err != "" || r.Volume.Status["holder"] == "" {
+			t.Errorf("Get returned %v (%s)", r.Volume, r.Err)
+		}
+	case <-mounted:
+		t.Fatal("Get waited for Mount")
+	}
+
+	if r := <-mounted; r.Err == "" {
+		t.Error("Mount of a locked image succeeded")
+	}
+}
+
+//-----------------------------------------------------------------------------
+// TestList
+//-----------------------------------------------------------------------------
+
+func TestList(t *testing.T) {
+
+	d, f := newTestDriver(t)
+	f.addImage("rbd", "one", "xfs")
+	f.addImage("rbd", "two", "xfs")
+	f.addImage("other", "three", "xfs")
+
+	if r := d.Mount(dkvolume.MountRequest{Name: "two", ID: "c1"}); r.Err != "" {
+		t.Fatalf("Mount: %s", r.Err)
+	}
+
+	r := d.List(dkvolume.Request{})
+	if r.Err != "" {
+		t.Fatalf("List: %s", r.Err)
+	}
+
+	got := map[string]string{}
+	for _, v := range r.Volumes {
+		got[v.Name] = v.Mountpoint
+	}
+
+	want := map[string]string{"one": "", "two": filepath.Join(d.volRoot, "ceph", "rbd", "two")}
+	if len(got) != len(want) || got["one"] != want["one"] || got["two"] != want["two"] {
+		t.Errorf("List returned %v, want %v", got, want)
+	}
+
+	// Only images created by this driver
+	d.ownedOnly = true
+	if r = d.List(dkvolume.Request{}); len(r.Volumes) != 0 {
+		t.Errorf("List of owned images returned %d volumes", len(r.Volumes))
+	}
+
+	// An unreachable pool hides only its own images
+	d.ownedOnly = false
+	d.clusters["ceph"].pools = []string{"rbd", "other"}
+	f.failOnce("list")
+
+	r = d.List(dkvolume.Request{})
+	if r.Err != "" || len(r.Volumes) != 1 || r.Volumes[0].Name != "three" {
+		t.Errorf("List with an unreachable pool returned %v (%s)", r.Volumes, r.Err)
+	}
+}
+
+//-----------------------------------------------------------------------------
+// TestListNames checks that List reports the names Docker resolves to each
+// image.
+//-----------------------------------------------------------------------------
+
+func TestListNames(t *testing.T) {
+
+	d, f := newTestDriver(t)
+	d.clusters["ceph"].pools = []string{"rbd", "ssd"}
+	f.addImage("rbd", "one", "xfs")
+	f.addImage("ssd", "two", "xfs")
+	f.addImage("rbd", "dup", "xfs")
+	f.addImage("ssd", "dup", "xfs")
+
+	names := func() map[string]string {
+		r := d.List(dkvolume.Request{})
+		if r.Err != "" {
+			t.Fatalf("List: %s", r.Err)
+		}
+		got := map[string]string{}
+		for _, v := range r.Volumes {
+			got[v.Name] = v.Status["pool"].(string)
+		}
+		return got
+	}
+
+	want := map[string]string{"one": "rbd", "two": "ssd", "dup": "rbd", "ssd/dup": "ssd"}
+	if got := names(); !reflect.DeepEqual(got, want) {
+		t.Errorf("List returned %v, want %v", got, want)
+	}
+
+	// A mounted image takes the bare name
+	if r := d.Mount(dkvolume.MountRequest{Name: "ssd/dup", ID: "c1"}); r.Err != "" {
+		t.Fatalf("Mount: %s", r.Err)
+	}
+
+	want = map[string]string{"one": "rbd", "two": "ssd", "rbd/dup": "rbd", "dup": "ssd"}
+	if got := names(); !reflect.DeepEqual(got, want) {
+		t.Errorf("List with a mounted image returned %v, want %v", got, want)
+	}
+
+	// Every name resolves to the image it was listed for
+	for name, pool := range want {
+		if _, p, _, _, err := d.resolveName(name); err != nil || p != pool {
+			t.Errorf("%s resolves to pool %q (%v), want %q", name, p, err, pool)
+		}
+	}
+}
+
+//-----------------------------------------------------------------------------
+// TestCapabilities
+//-----------------------------------------------------------------------------
+
+func TestCapabilities(t *testing.T) {
+
+	d, _ := newTestDriver(t)
+
+	if r := d.Capabilities(dkvolume.Request{}); r.Capabilities.Scope != "local" {
+		t.Errorf("Capabilities scope is %q, want local", r.Capabilities.Scope)
+	}
+}
+
+//-----------------------------------------------------------------------------
+// TestShuttingDown
+//-----------------------------------------------------------------------------
+
+func TestShuttingDown(t *testing.T) {
+
+	d, f := newTestDriver(t)
+	f.addImage("rbd", "data", "xfs")
+	d.closing = true
+
+	if r := d.Mount(dkvolume.MountRequest{Name: "data", ID: "c1"}); r.Err == "" {
+		t.Error("Mount succeeded while shutting down")
+	}
+
+	if r := d.Create(dkvolume.Request{Name: "new"}); r.Err == "" {
+		t.Error("Create succeeded while shutting down")
+	}
+}
@@ -0,0 +1,174 @@
+//-----------------------------------------------------------------------------
+// Package membership:
+//-----------------------------------------------------------------------------
+
+package main
+
+//-----------------------------------------------------------------------------
+// Imports:
+//-----------------------------------------------------------------------------
+
+import (
+
+	// Standard library:
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+//-----------------------------------------------------------------------------
+// Package constant declarations:
+//-----------------------------------------------------------------------------
+
+const (
+	errFailed      = "failed"
+	errNotFound    = "not found"
+	errLocked      = "already locked"
+	errPermission  = "permission denied"
+	errTimeout     = "timed out"
+	errBusy        = "busy"
+	errUnsupported = "unsupported feature"
+)
+
+//-----------------------------------------------------------------------------
+// Package variable declarations factored into a block:
+//-----------------------------------------------------------------------------
+
+// Lowercase stderr fragments of each error kind, checked in order.
+var errPatterns = []struct {
+	kind    string
+	needles []string
+}{
+	{errUnsupported, []string{"feature set mismatch", "unsupported feature"}},
+	{errPermission, []string{"permission denied", "operation not permitted", "(13)"}},
+	{errTimeout, []string{"timed out", "(110)"}},
+	{errNotFound, []string{"no such file or directory", "does not exist", "not found"}},
+	{errBusy, []string{"device or resource busy", "target is busy", "(16)"}},
+}
+
+//-----------------------------------------------------------------------------
+// Structs definitions:
+//-----------------------------------------------------------------------------
+
+// cmdError is a failed external command with what it printed to stderr.
+type cmdError struct {
+	op     string
+	args   []string
+	code   int
+	stderr string
+	kind   string
+	holder string
+}
+
+//-----------------------------------------------------------------------------
+// Error
+//-----------------------------------------------------------------------------
+
+func (e *cmdError) Error() string {
+
+	msg := e.op + ": " + e.kind
+	if e.kind == errLocked && e.holder != "" {
+		msg += " by " + e.holder
+	}
+
+	if e.code >= 0 {
+		msg += " (exit status " + strconv.Itoa(e.code) + ")"
+	}
+
+	// Keep every stderr line but in a single line
+	if words := strings.Fields(strings.Replace(e.stderr, "\n", " | ", -1)); len(words) > 0 {
+		msg += ": " + strings.Join(words, " ")
+	}
+
+	return msg
+}
+
+//-----------------------------------------------------------------------------
+// errorKind returns the kind of a command error or errFailed for any other
+// error.
+//-----------------------------------------------------------------------------
+
+func errorKind(err error) string {
+	if e, ok := err.(*cmdError); ok {
+		return e.kind
+	}
+	return errFailed
+}
+
+//-----------------------------------------------------------------------------
+// newCmdError builds a *cmdError from the exit status and stderr of a failed
+// command.
+//-----------------------------------------------------------------------------
+
+func newCmdError(op string, cmd *exec.Cmd, err error, stderr string) *cmdError {
+
+	e := &cmdError{
+		op:     op,
+		args:   cmd.Args,
+		code:   -1,
+		stderr: strings.TrimSpace(stderr),
+		kind:   errFailed,
+	}
+
+	// Exit status, if the command ran at all
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		if status, ok := exitErr.Sys().(syscall.WaitStatus); ok {
+			e.code = status.ExitStatus()
+		}
+	} else if e.stderr == "" {
+		e.stderr = err.Error()
+	}
+
+	// Classify by the stderr contents
+	lower := strings.ToLower(e.stderr)
+	for _, p := range errPatterns {
+		for _, needle := range p.needles {
+			if strings.Contains(lower, needle) {
+				e.kind = p.kind
+				break
+			}
+		}
+		if e.kind != errFailed {
+			break
+		}
+	}
+
+	return e
+}
+
+//-----------------------------------------------------------------------------
+// sysError builds a *cmdError from a failed system call, as when writing to
+// the sysfs bus files.
+//-----------------------------------------------------------------------------
+
+func sysError(op string, err error) error {
+
+	e := &cmdError{
+		op:     op,
+		code:   -1,
+		stderr: err.Error(),
+		kind:   errFailed,
+	}
+
+	if pathErr, ok := err.(*os.PathError); ok {
+		err = pathErr.Err
+	}
+
+	// Classify by errno
+	switch err {
+	case syscall.ENOENT:
+		e.kind = errNotFound
+	case syscall.EACCES, syscall.EPERM:
+		e.kind = errPermission
+	case syscall.EBUSY:
+		e.kind = errBusy
+	case syscall.ETIMEDOUT:
+		e.kind = errTimeout
+	case syscall.ENXIO:
+		e.kind = errUnsupported
+	}
+
+	return e
+}
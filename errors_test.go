@@ -0,0 +1,78 @@
+//-----------------------------------------------------------------------------
+// Package membership:
+//-----------------------------------------------------------------------------
+
+package main
+
+//-----------------------------------------------------------------------------
+// Imports:
+//-----------------------------------------------------------------------------
+
+import (
+
+	// Standard library:
+	"os/exec"
+	"strconv"
+	"testing"
+)
+
+//-----------------------------------------------------------------------------
+// exitError returns the error of a command that exits with the code.
+//-----------------------------------------------------------------------------
+
+func exitError(t *testing.T, code int) (*exec.Cmd, error) {
+
+	cmd := exec.Command("sh", "-c", "exit "+strconv.Itoa(code))
+	err := cmd.Run()
+	if _, ok := err.(*exec.ExitError); !ok {
+		t.Fatalf("sh exit %d returned %v", code, err)
+	}
+
+	return cmd, err
+}
+
+//-----------------------------------------------------------------------------
+// TestNewCmdError classifies what rbd, mount and mkfs print on failure.
+//-----------------------------------------------------------------------------
+
+func TestNewCmdError(t *testing.T) {
+
+	for _, c := range []struct {
+		code   int
+		stderr string
+		kind   string
+		lock   bool
+	}{
+		// rbd lock add on a lock held by another client
+		{16, "rbd: lock is already held by someone else", errLocked, true},
+		{17, "rbd: lock is already held by someone else with a different tag", errLocked, true},
+
+		// rbd lock add of a missing image is not a busy lock
+		{2, "rbd: error opening image data: (2) No such file or directory", errNotFound, true},
+		{1, "rbd: error opening image data: (1) Operation not permitted", errPermission, true},
+
+		{2, "rbd: error opening image data: (2) No such file or directory", errNotFound, false},
+		{13, "rbd: error opening pool 'rbd': (13) Permission denied", errPermission, false},
+		{110, "rbd: error connecting to the cluster: (110) Connection timed out", errTimeout, false},
+		{16, "rbd: sysfs write failed\nrbd: unmap failed: (16) Device or resource busy", errBusy, false},
+		{6, "rbd: sysfs write failed\nRBD image feature set mismatch. You can disable features unsupported by the kernel with \"rbd feature disable rbd/data object-map fast-diff deep-flatten\".\nrbd: map failed: (6) No such device or address", errUnsupported, false},
+		{32, "umount: /var/lib/docker/volumes/rbd/ceph/rbd/data: target is busy.", errBusy, false},
+
+		// Man page sections are not errno values
+		{32, "mount: /mnt: wrong fs type, bad option, bad superblock on /dev/rbd0, missing codepage or helper program, or other error.\n       dmesg(1) may have more information after failed mount system call.", errFailed, false},
+		{32, "mount: /mnt: mount(2) system call failed: Structure needs cleaning.", errFailed, false},
+		{1, "mkfs.xfs: /dev/rbd0 appears to contain an existing filesystem (xfs).", errFailed, false},
+	} {
+		cmd, err := exitError(t, c.code)
+
+		var got error = newCmdError("Test", cmd, err, c.stderr)
+		if c.lock {
+			got = lockError(got)
+		}
+
+		e := got.(*cmdError)
+		if e.kind != c.kind || e.code != c.code {
+			t.Errorf("%q exiting with %d is %q with code %d, want %q", c.stderr, c.code, e.kind, e.code, c.kind)
+		}
+	}
+}
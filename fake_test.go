@@ -0,0 +1,600 @@
+//-----------------------------------------------------------------------------
+// Package membership:
+//-----------------------------------------------------------------------------
+
+package main
+
+//-----------------------------------------------------------------------------
+// Imports:
+//-----------------------------------------------------------------------------
+
+import (
+
+	// Standard library:
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+//-----------------------------------------------------------------------------
+// Package variable declarations factored into a block:
+//-----------------------------------------------------------------------------
+
+var (
+	_ blockBackend = (*fakeCeph)(nil)
+	_ mapper       = (*fakeCeph)(nil)
+	_ hostBackend  = (*fakeCeph)(nil)
+
+	// Features of an image created without an explicit set:
+	fakeDefFeatures = []string{"layering", "exclusive-lock", "object-map", "fast-diff", "deep-flatten"}
+)
+
+//-----------------------------------------------------------------------------
+// Structs definitions:
+//-----------------------------------------------------------------------------
+
+// fakeImage is an RBD image with the file system written on it.
+type fakeImage struct {
+	size     int
+	features []string
+	meta     map[string]string
+	locks    []lockHolder
+	watchers []string
+	snaps    []string
+	fstype   string
+	used     uint64
+}
+
+// fakeCeph is an in-memory cluster, kernel client and host. It implements
+// blockBackend, mapper and hostBackend. Any operation can be made to fail.
+type fakeCeph struct {
+	mutex   sync.Mutex
+	images  map[string]*fakeImage
+	devices map[string]mapping
+	clients map[string]string
+	mounts  map[string]string
+	failing map[string]bool
+	once    map[string]bool
+	hooks   map[string]func(n int)
+	calls   map[string]int
+	fenced  []string
+	serial  int
+}
+
+//-----------------------------------------------------------------------------
+// newFakeCeph
+//-----------------------------------------------------------------------------
+
+func newFakeCeph() *fakeCeph {
+	return &fakeCeph{
+		images:  map[string]*fakeImage{},
+		devices: map[string]mapping{},
+		clients: map[string]string{},
+		mounts:  map[string]string{},
+		failing: map[string]bool{},
+		once:    map[string]bool{},
+		hooks:   map[string]func(n int){},
+		calls:   map[string]int{},
+	}
+}
+
+//-----------------------------------------------------------------------------
+// newTestDriver returns a driver with a single cluster named ceph backed by a
+// fake, mounting below a temporary directory.
+//-----------------------------------------------------------------------------
+
+func newTestDriver(t *testing.T) (*rbdDriver, *fakeCeph) {
+
+	f := newFakeCeph()
+	d := &rbdDriver{
+		volRoot:    t.TempDir(),
+		defFsType:  "xfs",
+		defSize:    1024,
+		defCluster: "ceph",
+		defMapping: mappingKRBD,
+		defLocking: lockingAdvisory,
+		clusters:   map[string]*cluster{},
+		order:      []string{"ceph"},
+		remove:     removeDelete,
+		hostname:   "node1",
+		instance:   "0a1b2c3d",
+		host:       f,
+		volumes:    map[string]*volume{},
+		locks:      map[string]*volumeLock{},
+	}
+
+	d.clusters["ceph"] = newCluster("ceph", clusterConfig{}, f, map[string]mapper{mappingKRBD: f})
+	return d, f
+}
+
+//-----------------------------------------------------------------------------
+// Fault injection:
+//-----------------------------------------------------------------------------
+
+// fail makes every later call of the operation fail.
+func (f *fakeCeph) fail(op string) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.failing[op] = true
+}
+
+// failOnce makes the next call of the operation fail.
+func (f *fakeCeph) failOnce(op string) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.once[op] = true
+}
+
+// heal makes the operation succeed again.
+func (f *fakeCeph) heal(op string) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	delete(f.failing, op)
+	delete(f.once, op)
+}
+
+// hook runs a function, with the mutex held, before every call of the
+// operation. It gets the number of the call.
+func (f *fakeCeph) hook(op string, fn func(n int)) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.hooks[op] = fn
+}
+
+// check runs the hook and returns the injected failure of the operation, if
+// any. The caller must hold the mutex.
+func (f *fakeCeph) check(op string) error {
+	f.calls[op]++
+	if fn := f.hooks[op]; fn != nil {
+		fn(f.calls[op])
+	}
+	if f.failing[op] || f.once[op] {
+		delete(f.once, op)
+		return &cmdError{op: "Fake " + op, code: 1, stderr: "injected failure", kind: errFailed}
+	}
+	return nil
+}
+
+// image returns an image or a not found error. The caller must hold the
+// mutex.
+func (f *fakeCeph) image(op, pool, name string) (*fakeImage, error) {
+	if err := f.check(op); err != nil {
+		return nil, err
+	}
+	img, found := f.images[pool+"/"+name]
+	if !found {
+		return nil, &cmdError{op: "Fake " + op, code: 2, stderr: "image " + name + " does not exist", kind: errNotFound}
+	}
+	return img, nil
+}
+
+// next returns a new client number. The caller must hold the mutex.
+func (f *fakeCeph) next() string {
+	f.serial++
+	return strconv.Itoa(f.serial)
+}
+
+//-----------------------------------------------------------------------------
+// Helpers for the tests:
+//-----------------------------------------------------------------------------
+
+// addImage creates a formatted image.
+func (f *fakeCeph) addImage(pool, name, fstype string) *fakeImage {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	img := &fakeImage{size: 1024, features: fakeDefFeatures, meta: map[string]string{}, fstype: fstype}
+	f.images[pool+"/"+name] = img
+	return img
+}
+
+// addLock takes a lock as another client would.
+func (f *fakeCeph) addLock(pool, name, lockID string) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	n := f.next()
+	img := f.images[pool+"/"+name]
+	img.locks = append(img.locks, lockHolder{id: lockID, locker: "client." + n, address: "10.0.0.2:0/" + n})
+}
+
+// hasImage tells whether the image exists.
+func (f *fakeCeph) hasImage(pool, name string) bool {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	_, found := f.images[pool+"/"+name]
+	return found
+}
+
+// leaks describes the locks, mappings and mounts left.
+func (f *fakeCeph) leaks() []string {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	left := []string{}
+	for key, img := range f.images {
+		for _, l := range img.locks {
+			left = append(left, "lock "+l.id+" on "+key)
+		}
+		for _, w := range img.watchers {
+			left = append(left, "watcher "+w+" on "+key)
+		}
+	}
+	for device, m := range f.devices {
+		left = append(left, "mapping "+device+" of "+m.pool+"/"+m.name)
+	}
+	for mountpoint, device := range f.mounts {
+		left = append(left, "mount "+device+" on "+mountpoint)
+	}
+
+	sort.Strings(left)
+	return left
+}
+
+//-----------------------------------------------------------------------------
+// blockBackend:
+//-----------------------------------------------------------------------------
+
+func (f *fakeCeph) listImages(pool string) ([]string, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if err := f.check("list"); err != nil {
+		return nil, err
+	}
+	list := []string{}
+	for key := range f.images {
+		if strings.HasPrefix(key, pool+"/") {
+			list = append(list, strings.TrimPrefix(key, pool+"/"))
+		}
+	}
+	sort.Strings(list)
+	return list, nil
+}
+
+func (f *fakeCeph) infoImage(pool, name string) (*imageInfo, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	img, err := f.image("info", pool, name)
+	if err != nil {
+		return nil, err
+	}
+	return &imageInfo{size: uint64(img.size) << 20, features: append([]string{}, img.features...)}, nil
+}
+
+func (f *fakeCeph) usageImage(pool, name string) (uint64, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	img, err := f.image("du", pool, name)
+	if err != nil {
+		return 0, err
+	}
+	return img.used, nil
+}
+
+func (f *fakeCeph) listSnapshots(pool, name string) ([]string, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	img, err := f.image("snap", pool, name)
+	if err != nil {
+		return nil, err
+	}
+	return append([]string{}, img.snaps...), nil
+}
+
+func (f *fakeCeph) createImage(pool, name string, size int, features []string) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if err := f.check("create"); err != nil {
+		return err
+	}
+	if _, found := f.images[pool+"/"+name]; found {
+		return &cmdError{op: "Fake create", code: 17, stderr: "image already exists", kind: errFailed}
+	}
+	if len(features) == 0 {
+		features = fakeDefFeatures
+	}
+	f.images[pool+"/"+name] = &fakeImage{size: size, features: append([]string{}, features...), meta: map[string]string{}}
+	return nil
+}
+
+func (f *fakeCeph) removeImage(pool, name string) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	img, err := f.image("remove", pool, name)
+	if err != nil {
+		return err
+	}
+	if len(img.watchers) > 0 {
+		return &cmdError{op: "Fake remove", code: 16, stderr: "image still has watchers", kind: errBusy}
+	}
+	delete(f.images, pool+"/"+name)
+	return nil
+}
+
+func (f *fakeCeph) renameImage(pool, name, newName string) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	img, err := f.image("rename", pool, name)
+	if err != nil {
+		return err
+	}
+	delete(f.images, pool+"/"+name)
+	f.images[pool+"/"+newName] = img
+	return nil
+}
+
+func (f *fakeCeph) purgeSnapshots(pool, name string) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	img, err := f.image("purge", pool, name)
+	if err != nil {
+		return err
+	}
+	img.snaps = nil
+	return nil
+}
+
+func (f *fakeCeph) disableFeatures(pool, name string, features []string) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	img, err := f.image("features", pool, name)
+	if err != nil {
+		return err
+	}
+	kept := []string{}
+	for _, have := range img.features {
+		disabled := false
+		for _, off := range features {
+			disabled = disabled || have == off
+		}
+		if !disabled {
+			kept = append(kept, have)
+		}
+	}
+	img.features = kept
+	return nil
+}
+
+func (f *fakeCeph) setImageMeta(pool, name, key, value string) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	img, err := f.image("meta", pool, name)
+	if err != nil {
+		return err
+	}
+	img.meta[key] = value
+	return nil
+}
+
+func (f *fakeCeph) getImageMeta(pool, name, key string) (string, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	img, err := f.image("meta get", pool, name)
+	if err != nil {
+		return "", err
+	}
+	value, found := img.meta[key]
+	if !found {
+		return "", &cmdError{op: "Fake meta get", code: 2, stderr: "no such metadata key", kind: errNotFound}
+	}
+	return value, nil
+}
+
+func (f *fakeCeph) removeImageMeta(pool, name, key string) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	img, err := f.image("meta remove", pool, name)
+	if err != nil {
+		return err
+	}
+	delete(img.meta, key)
+	return nil
+}
+
+func (f *fakeCeph) lockImage(pool, name, lockID string) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	img, err := f.image("lock", pool, name)
+	if err != nil {
+		return err
+	}
+	if len(img.locks) > 0 {
+		// As rbd prints it, classified like rbdCLI does
+		return lockError(&cmdError{op: "Fake lock", code: 16, stderr: "rbd: lock is already held by someone else", kind: errFailed})
+	}
+	n := f.next()
+	img.locks = append(img.locks, lockHolder{id: lockID, locker: "client." + n, address: "10.0.0.1:0/" + n})
+	return nil
+}
+
+func (f *fakeCeph) listLocks(pool, name string) ([]lockHolder, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	img, err := f.image("locks", pool, name)
+	if err != nil {
+		return nil, err
+	}
+	return append([]lockHolder{}, img.locks...), nil
+}
+
+func (f *fakeCeph) unlockImage(pool, name, lockID, locker string) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	img, err := f.image("unlock", pool, name)
+	if err != nil {
+		return err
+	}
+	for i, l := range img.locks {
+		if l.id == lockID && l.locker == locker {
+			img.locks = append(img.locks[:i], img.locks[i+1:]...)
+			return nil
+		}
+	}
+	return &cmdError{op: "Fake unlock", code: 2, stderr: "no such lock", kind: errNotFound}
+}
+
+func (f *fakeCeph) listWatchers(pool, name string) ([]string, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	img, err := f.image("watchers", pool, name)
+	if err != nil {
+		return nil, err
+	}
+	return append([]string{}, img.watchers...), nil
+}
+
+func (f *fakeCeph) blocklistClient(address string) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if err := f.check("blocklist"); err != nil {
+		return err
+	}
+	f.fenced = append(f.fenced, address)
+	return nil
+}
+
+//-----------------------------------------------------------------------------
+// mapper:
+//-----------------------------------------------------------------------------
+
+func (f *fakeCeph) mapImage(pool, name string, opts mapOpts) (string, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	img, err := f.image("map", pool, name)
+	if err != nil {
+		return "", err
+	}
+	n := f.next()
+	device := "/dev/rbd" + n
+	client := "10.0.0.1:0/" + n
+	img.watchers = append(img.watchers, client)
+	f.devices[device] = mapping{pool: pool, name: name, device: device, mode: mappingKRBD}
+	f.clients[device] = client
+	return device, nil
+}
+
+func (f *fakeCeph) unmapImage(device string) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if err := f.check("unmap"); err != nil {
+		return err
+	}
+	m, found := f.devices[device]
+	if !found {
+		return &cmdError{op: "Fake unmap", code: 22, stderr: device + " is not mapped", kind: errFailed}
+	}
+	for _, dev := range f.mounts {
+		if dev == device {
+			return &cmdError{op: "Fake unmap", code: 16, stderr: "device or resource busy", kind: errBusy}
+		}
+	}
+	if img, found := f.images[m.pool+"/"+m.name]; found {
+		for i, w := range img.watchers {
+			if w == f.clients[device] {
+				img.watchers = append(img.watchers[:i], img.watchers[i+1:]...)
+				break
+			}
+		}
+	}
+	delete(f.devices, device)
+	delete(f.clients, device)
+	return nil
+}
+
+func (f *fakeCeph) showMapped() (map[string]mapping, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if err := f.check("showmapped"); err != nil {
+		return nil, err
+	}
+	mapped := map[string]mapping{}
+	for device, m := range f.devices {
+		mapped[device] = m
+	}
+	return mapped, nil
+}
+
+//-----------------------------------------------------------------------------
+// hostBackend:
+//-----------------------------------------------------------------------------
+
+// mapped returns the image mapped to a device. The caller must hold the
+// mutex.
+func (f *fakeCeph) mapped(op, device string) (*fakeImage, error) {
+	if err := f.check(op); err != nil {
+		return nil, err
+	}
+	m, found := f.devices[device]
+	if !found {
+		return nil, &cmdError{op: "Fake " + op, code: 2, stderr: device + " does not exist", kind: errNotFound}
+	}
+	return f.images[m.pool+"/"+m.name], nil
+}
+
+func (f *fakeCeph) makeFs(device, fsType, mkfsOpts string) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	img, err := f.mapped("mkfs", device)
+	if err != nil {
+		return err
+	}
+	img.fstype = fsType
+	return nil
+}
+
+func (f *fakeCeph) mountDevice(device, mountpoint, fsType, mntOpts string) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	img, err := f.mapped("mount", device)
+	if err != nil {
+		return err
+	}
+	if img.fstype == "" || img.fstype != fsType {
+		return &cmdError{op: "Fake mount", code: 32, stderr: "wrong fs type", kind: errFailed}
+	}
+	if _, found := f.mounts[mountpoint]; found {
+		return &cmdError{op: "Fake mount", code: 32, stderr: mountpoint + " already mounted", kind: errBusy}
+	}
+	f.mounts[mountpoint] = device
+	return nil
+}
+
+func (f *fakeCeph) unmountDevice(device string) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if err := f.check("umount"); err != nil {
+		return err
+	}
+	for mountpoint, dev := range f.mounts {
+		if dev == device {
+			delete(f.mounts, mountpoint)
+			return nil
+		}
+	}
+	return &cmdError{op: "Fake umount", code: 32, stderr: device + ": not mounted", kind: errFailed}
+}
+
+func (f *fakeCeph) probeDevice(device string) (string, string, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	img, err := f.mapped("probe", device)
+	if err != nil {
+		return "", "", err
+	}
+	return img.fstype, "", nil
+}
+
+func (f *fakeCeph) listMounts(root string) (map[string]string, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if err := f.check("mounts"); err != nil {
+		return nil, err
+	}
+	mounts := map[string]string{}
+	for mountpoint, device := range f.mounts {
+		if strings.HasPrefix(mountpoint, root+"/") {
+			mounts[mountpoint] = device
+		}
+	}
+	return mounts, nil
+}
@@ -0,0 +1,175 @@
+//-----------------------------------------------------------------------------
+// Package membership:
+//-----------------------------------------------------------------------------
+
+package main
+
+//-----------------------------------------------------------------------------
+// Imports:
+//-----------------------------------------------------------------------------
+
+import (
+
+	// Standard library:
+	"errors"
+	"io/ioutil"
+	"os/exec"
+	"strings"
+)
+
+//-----------------------------------------------------------------------------
+// Structs definitions:
+//-----------------------------------------------------------------------------
+
+// hostCLI implements hostBackend with the host command line tools.
+type hostCLI struct {
+	cmd    map[string]string
+	runner *runner
+}
+
+//-----------------------------------------------------------------------------
+// newHostCLI
+//-----------------------------------------------------------------------------
+
+func newHostCLI(cmd map[string]string, r *runner) *hostCLI {
+	return &hostCLI{cmd: cmd, runner: r}
+}
+
+//-----------------------------------------------------------------------------
+// makeFs
+//-----------------------------------------------------------------------------
+
+func (c *hostCLI) makeFs(device, fsType, mkfsOpts string) error {
+
+	// Search for mkfs
+	mkfs, err := exec.LookPath("mkfs." + fsType)
+	if err != nil {
+		return errors.New("Unable to find mkfs." + fsType)
+	}
+
+	// Make the file system
+	args := append(strings.Fields(mkfsOpts), device)
+	if _, err = c.runner.run("mkfs", "Unable to make file system on "+device, exec.Command(mkfs, args...)); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+//-----------------------------------------------------------------------------
+// mountDevice
+//-----------------------------------------------------------------------------
+
+func (c *hostCLI) mountDevice(device, mountpoint, fsType, mntOpts string) error {
+
+	// Mount options are optional
+	args := []string{"-t", fsType}
+	if mntOpts != "" {
+		args = append(args, "-o", mntOpts)
+	}
+
+	// Mount the device
+	_, err := c.runner.run("mount", "Unable to mount "+device+" on "+mountpoint, exec.Command(
+		c.cmd["mount"],
+		append(args, device, mountpoint)...,
+	))
+
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+//-----------------------------------------------------------------------------
+// probeDevice returns the file system type and partition table type found on
+// the device. Both are empty if the device holds no known signature.
+//-----------------------------------------------------------------------------
+
+func (c *hostCLI) probeDevice(device string) (string, string, error) {
+
+	// Low-level probe, bypassing the blkid cache
+	out, err := c.runner.run("probe", "Unable to probe "+device, exec.Command(
+		c.cmd["blkid"],
+		"-p", "-o", "export",
+		device,
+	))
+
+	if err != nil {
+
+		// Exit status 2 means no signature was found
+		if e, ok := err.(*cmdError); ok && e.code == 2 {
+			return "", "", nil
+		}
+
+		return "", "", err
+	}
+
+	// Parse the KEY=value output
+	var fstype, pttype string
+	for _, line := range strings.Split(string(out), "\n") {
+		switch {
+		case strings.HasPrefix(line, "TYPE="):
+			fstype = strings.TrimPrefix(line, "TYPE=")
+		case strings.HasPrefix(line, "PTTYPE="):
+			pttype = strings.TrimPrefix(line, "PTTYPE=")
+		}
+	}
+
+	return fstype, pttype, nil
+}
+
+//-----------------------------------------------------------------------------
+// listMounts returns the devices mounted below root indexed by mountpoint.
+//-----------------------------------------------------------------------------
+
+func (c *hostCLI) listMounts(root string) (map[string]string, error) {
+
+	// Read the mount table of this process
+	data, err := ioutil.ReadFile("/proc/self/mountinfo")
+	if err != nil {
+		return nil, errors.New("Unable to read the mount table")
+	}
+
+	// Mountpoints are octal escaped
+	unescape := strings.NewReplacer(`\040`, " ", `\011`, "\t", `\012`, "\n", `\134`, `\`)
+
+	mounts := map[string]string{}
+	for _, line := range strings.Split(string(data), "\n") {
+
+		// The optional fields end with a single hyphen
+		f := strings.Fields(line)
+		sep := -1
+		for i := 6; i < len(f); i++ {
+			if f[i] == "-" {
+				sep = i
+				break
+			}
+		}
+
+		if sep < 0 || sep+2 >= len(f) {
+			continue
+		}
+
+		mountpoint := unescape.Replace(f[4])
+		if strings.HasPrefix(mountpoint, root+"/") {
+			mounts[mountpoint] = unescape.Replace(f[sep+2])
+		}
+	}
+
+	return mounts, nil
+}
+
+//-----------------------------------------------------------------------------
+// unmountDevice
+//-----------------------------------------------------------------------------
+
+func (c *hostCLI) unmountDevice(device string) error {
+
+	// Unmount the device
+	if _, err := c.runner.run("umount", "Unable to umount "+device, exec.Command(c.cmd["umount"], device)); err != nil {
+		return err
+	}
+
+	return nil
+}
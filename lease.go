@@ -0,0 +1,212 @@
+//-----------------------------------------------------------------------------
+// Package membership:
+//-----------------------------------------------------------------------------
+
+package main
+
+//-----------------------------------------------------------------------------
+// Imports:
+//-----------------------------------------------------------------------------
+
+import (
+
+	// Standard library:
+	"errors"
+	"log"
+	"strings"
+	"time"
+)
+
+//-----------------------------------------------------------------------------
+// Structs definitions:
+//-----------------------------------------------------------------------------
+
+// lease is stored in the image metadata as "expiry lockID" and renewed while
+// the volume is mounted. A holder that stops renewing is considered dead.
+type lease struct {
+	lockID string
+	expiry time.Time
+}
+
+// leaseStatus is the renewal history of a volume mounted on this host. A
+// lost lease is no longer renewed, its lock is gone.
+type leaseStatus struct {
+	expiry   time.Time
+	renewed  time.Time
+	failures int
+	lastErr  string
+	lost     bool
+}
+
+//-----------------------------------------------------------------------------
+// String
+//-----------------------------------------------------------------------------
+
+func (l lease) String() string {
+	return l.expiry.UTC().Format(time.RFC3339) + " " + l.lockID
+}
+
+//-----------------------------------------------------------------------------
+// parseLease
+//-----------------------------------------------------------------------------
+
+func parseLease(value string) (lease, error) {
+
+	f := strings.SplitN(strings.TrimSpace(value), " ", 2)
+	if len(f) != 2 {
+		return lease{}, errors.New("Invalid lease: " + value)
+	}
+
+	expiry, err := time.Parse(time.RFC3339, f[0])
+	if err != nil {
+		return lease{}, errors.New("Invalid lease: " + value)
+	}
+
+	return lease{lockID: f[1], expiry: expiry}, nil
+}
+
+//-----------------------------------------------------------------------------
+// imageLease returns the lease stored with the image, if any.
+//-----------------------------------------------------------------------------
+
+func (d *rbdDriver) imageLease(cl *cluster, pool, name string) (lease, bool) {
+
+	value, err := cl.rbd.getImageMeta(pool, name, metaLease)
+	if err != nil || value == "" {
+		return lease{}, false
+	}
+
+	l, err := parseLease(value)
+	if err != nil {
+		log.Printf("[Lease] WARN %s/%s/%s: %s", cl.name, pool, name, err)
+		return lease{}, false
+	}
+
+	return l, true
+}
+
+//-----------------------------------------------------------------------------
+// renewLease extends the lease of a volume mounted on this host and records
+// the outcome. The lease is lost if the lock is gone, as after a takeover,
+// so that the lease of the new holder is never overwritten.
+//-----------------------------------------------------------------------------
+
+func (d *rbdDriver) renewLease(cl *cluster, vol *volume) error {
+
+	// The lock must still be ours
+	locks, err := d.imageLocks(cl, vol.pool, vol.name)
+	lost := err == nil
+	for _, h := range locks {
+		if h.id == vol.lockID {
+			lost = false
+		}
+	}
+
+	l := lease{lockID: vol.lockID, expiry: time.Now().Add(d.leaseTTL)}
+	if lost {
+		err = errors.New("Lock " + vol.lockID + " is gone")
+	} else if err == nil {
+		err = cl.rbd.setImageMeta(vol.pool, vol.name, metaLease, l.String())
+	}
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	if err != nil {
+		vol.lease.lost = lost
+		vol.lease.failures++
+		vol.lease.lastErr = err.Error()
+		return err
+	}
+
+	vol.lease.expiry = l.expiry
+	vol.lease.renewed = time.Now()
+	vol.lease.lastErr = ""
+
+	return nil
+}
+
+//-----------------------------------------------------------------------------
+// releaseLease removes the lease of a volume.
+//-----------------------------------------------------------------------------
+
+func (d *rbdDriver) releaseLease(cl *cluster, vol *volume) error {
+	return cl.rbd.removeImageMeta(vol.pool, vol.name, metaLease)
+}
+
+//-----------------------------------------------------------------------------
+// renewLeases runs forever renewing the leases of the mounted volumes three
+// times per TTL.
+//-----------------------------------------------------------------------------
+
+func (d *rbdDriver) renewLeases() {
+	for range time.Tick(d.leaseTTL / 3) {
+		d.renewAll()
+	}
+}
+
+//-----------------------------------------------------------------------------
+// renewAll renews the leases of the mounted volumes once, but the lost ones.
+//-----------------------------------------------------------------------------
+
+func (d *rbdDriver) renewAll() {
+
+	for _, mountpoint := range d.mountpoints() {
+
+		vol, found := d.getVolume(mountpoint)
+		if !found || vol.lockID == "" {
+			continue
+		}
+
+		cl := d.clusters[vol.cluster]
+		unlock := d.lockVolume(cl, vol.pool, vol.name)
+
+		// Unmounted in the meantime or lost
+		if _, found = d.getVolume(mountpoint); !found || d.leaseStatus(vol)["lost"] == true {
+			unlock()
+			continue
+		}
+
+		if err := d.renewLease(cl, vol); err != nil {
+			switch status := d.leaseStatus(vol); {
+			case status["lost"] == true:
+				log.Printf("[Lease] ERROR lock of %s/%s/%s is gone, it may have been taken over, no longer renewing its lease: %s", vol.cluster, vol.pool, vol.name, err)
+			case status["expired"] == true:
+				log.Printf("[Lease] ERROR lease of %s/%s/%s expired, other hosts may take it over: %s", vol.cluster, vol.pool, vol.name, err)
+			default:
+				log.Printf("[Lease] WARN unable to renew the lease of %s/%s/%s: %s", vol.cluster, vol.pool, vol.name, err)
+			}
+		}
+
+		unlock()
+	}
+}
+
+//-----------------------------------------------------------------------------
+// leaseStatus reports the lease of a volume mounted on this host.
+//-----------------------------------------------------------------------------
+
+func (d *rbdDriver) leaseStatus(vol *volume) map[string]interface{} {
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	status := map[string]interface{}{
+		"expires":  "",
+		"expired":  !vol.lease.expiry.After(time.Now()),
+		"renewed":  "",
+		"failures": vol.lease.failures,
+		"error":    vol.lease.lastErr,
+		"lost":     vol.lease.lost,
+	}
+
+	if !vol.lease.expiry.IsZero() {
+		status["expires"] = vol.lease.expiry.UTC().Format(time.RFC3339)
+	}
+
+	if !vol.lease.renewed.IsZero() {
+		status["renewed"] = vol.lease.renewed.UTC().Format(time.RFC3339)
+	}
+
+	return status
+}
@@ -0,0 +1,189 @@
+//-----------------------------------------------------------------------------
+// Package membership:
+//-----------------------------------------------------------------------------
+
+package main
+
+//-----------------------------------------------------------------------------
+// Imports:
+//-----------------------------------------------------------------------------
+
+import (
+
+	// Standard library:
+	"testing"
+	"time"
+
+	// Community:
+	dkvolume "github.com/docker/go-plugins-helpers/volume"
+)
+
+//-----------------------------------------------------------------------------
+// TestParseLease
+//-----------------------------------------------------------------------------
+
+func TestParseLease(t *testing.T) {
+
+	l := lease{lockID: staleID, expiry: time.Date(2026, 10, 16, 12, 0, 0, 0, time.UTC)}
+	if got, err := parseLease(l.String()); err != nil || got != l {
+		t.Errorf("parseLease(%q) returned %+v (%v)", l.String(), got, err)
+	}
+
+	for _, value := range []string{"", "2026-10-16T12:00:00Z", "tomorrow " + staleID} {
+		if _, err := parseLease(value); err == nil {
+			t.Errorf("parseLease(%q) succeeded", value)
+		}
+	}
+}
+
+//-----------------------------------------------------------------------------
+// mountLeased mounts rbd/data with leases enabled.
+//-----------------------------------------------------------------------------
+
+func mountLeased(t *testing.T) (*rbdDriver, *fakeCeph, *fakeImage, *volume) {
+
+	d, f := newTestDriver(t)
+	d.leaseTTL = time.Minute
+	img := f.addImage("rbd", "data", "xfs")
+
+	r := d.Mount(dkvolume.MountRequest{Name: "data", ID: "c1"})
+	if r.Err != "" {
+		t.Fatalf("Mount: %s", r.Err)
+	}
+
+	vol, _ := d.getVolume(r.Mountpoint)
+	return d, f, img, vol
+}
+
+//-----------------------------------------------------------------------------
+// TestLeaseRenewal
+//-----------------------------------------------------------------------------
+
+func TestLeaseRenewal(t *testing.T) {
+
+	d, f, img, vol := mountLeased(t)
+
+	// Mount starts the lease
+	l, err := parseLease(img.meta[metaLease])
+	if err != nil || l.lockID != vol.lockID || l.expiry.Before(time.Now().Add(50*time.Second)) {
+		t.Fatalf("Mount left the lease %q (%v)", img.meta[metaLease], err)
+	}
+
+	// Renewals rewrite it
+	delete(img.meta, metaLease)
+	d.renewAll()
+
+	if l, err = parseLease(img.meta[metaLease]); err != nil || l.lockID != vol.lockID {
+		t.Errorf("renewal left the lease %q (%v)", img.meta[metaLease], err)
+	}
+
+	r := d.Get(dkvolume.Request{Name: "data"})
+	if r.Err != "" {
+		t.Fatalf("Get: %s", r.Err)
+	}
+
+	shared, _ := r.Volume.Status["lease"].(map[string]interface{})
+	if shared["holder"] != vol.lockID || shared["expired"] != false {
+		t.Errorf("status lease is %v", shared)
+	}
+
+	renewal, _ := r.Volume.Status["renewal"].(map[string]interface{})
+	if renewal["expires"] == "" || renewal["renewed"] == "" || renewal["failures"] != 0 || renewal["lost"] != false {
+		t.Errorf("status renewal is %v", renewal)
+	}
+
+	// Unmount ends it
+	if r := d.Unmount(dkvolume.UnmountRequest{Name: "data", ID: "c1"}); r.Err != "" {
+		t.Fatalf("Unmount: %s", r.Err)
+	}
+
+	if _, found := img.meta[metaLease]; found {
+		t.Error("Unmount kept the lease")
+	}
+
+	if left := f.leaks(); len(left) > 0 {
+		t.Errorf("Unmount left %v", left)
+	}
+}
+
+//-----------------------------------------------------------------------------
+// TestLeaseExpiry
+//-----------------------------------------------------------------------------
+
+func TestLeaseExpiry(t *testing.T) {
+
+	d, f, img, vol := mountLeased(t)
+
+	// Renewals fail until the lease expires
+	img.meta[metaLease] = lease{lockID: vol.lockID, expiry: time.Now().Add(-time.Second)}.String()
+	d.mutex.Lock()
+	vol.lease.expiry = time.Now().Add(-time.Second)
+	d.mutex.Unlock()
+	f.fail("meta")
+
+	d.renewAll()
+	d.renewAll()
+
+	r := d.Get(dkvolume.Request{Name: "data"})
+	if r.Err != "" {
+		t.Fatalf("Get: %s", r.Err)
+	}
+
+	shared, _ := r.Volume.Status["lease"].(map[string]interface{})
+	if shared["holder"] != vol.lockID || shared["expired"] != true {
+		t.Errorf("status lease is %v", shared)
+	}
+
+	renewal, _ := r.Volume.Status["renewal"].(map[string]interface{})
+	if renewal["expired"] != true || renewal["failures"] != 2 || renewal["error"] == "" || renewal["lost"] != false {
+		t.Errorf("status renewal is %v", renewal)
+	}
+
+	// A later renewal recovers
+	f.heal("meta")
+	d.renewAll()
+
+	if renewal = d.leaseStatus(vol); renewal["expired"] != false || renewal["error"] != "" {
+		t.Errorf("status renewal after recovery is %v", renewal)
+	}
+}
+
+//-----------------------------------------------------------------------------
+// TestLeaseLost checks that a host whose lock was taken over stops renewing
+// and leaves the lease of the new holder alone.
+//-----------------------------------------------------------------------------
+
+func TestLeaseLost(t *testing.T) {
+
+	d, f, img, vol := mountLeased(t)
+
+	// Another host took the lock over
+	f.mutex.Lock()
+	img.locks = []lockHolder{{id: staleID, locker: "client.900", address: "10.0.0.2:0/900"}}
+	theirs := lease{lockID: staleID, expiry: time.Now().Add(time.Minute)}.String()
+	img.meta[metaLease] = theirs
+	f.mutex.Unlock()
+
+	d.renewAll()
+
+	if img.meta[metaLease] != theirs {
+		t.Errorf("renewal overwrote the lease of the new holder with %q", img.meta[metaLease])
+	}
+
+	if status := d.leaseStatus(vol); status["lost"] != true || status["failures"] != 1 {
+		t.Errorf("status renewal is %v", status)
+	}
+
+	// No more attempts
+	calls := f.calls["locks"]
+	d.renewAll()
+
+	if f.calls["locks"] != calls || d.leaseStatus(vol)["failures"] != 1 {
+		t.Error("renewal went on after losing the lock")
+	}
+
+	r := d.Get(dkvolume.Request{Name: "data"})
+	if shared, _ := r.Volume.Status["lease"].(map[string]interface{}); shared["holder"] != staleID {
+		t.Errorf("status lease is %v", shared)
+	}
+}
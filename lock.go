@@ -0,0 +1,332 @@
+//-----------------------------------------------------------------------------
+// Package membership:
+//-----------------------------------------------------------------------------
+
+package main
+
+//-----------------------------------------------------------------------------
+// Imports:
+//-----------------------------------------------------------------------------
+
+import (
+
+	// Standard library:
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"log"
+	"strings"
+	"time"
+)
+
+//-----------------------------------------------------------------------------
+// Package constant declarations factored into a block:
+//-----------------------------------------------------------------------------
+
+const (
+	lockPrefix   = "dockerLock"
+	lockSep      = ":"
+	callerLength = 12
+)
+
+//-----------------------------------------------------------------------------
+// Structs definitions:
+//-----------------------------------------------------------------------------
+
+// lockHolder is an RBD lock. Locks taken by this driver have an ID such as
+// dockerLock:host:instance:caller, older versions used a bare dockerLock.
+type lockHolder struct {
+	id      string
+	locker  string
+	address string
+}
+
+//-----------------------------------------------------------------------------
+// newInstanceID returns a random ID for this plugin process.
+//-----------------------------------------------------------------------------
+
+func newInstanceID() string {
+	b := make([]byte, 4)
+	if _, err := rand.Read(b); err != nil {
+		return "unknown"
+	}
+	return hex.EncodeToString(b)
+}
+
+//-----------------------------------------------------------------------------
+// lockID returns the lock ID for a caller, a mount ID or an operation name.
+//-----------------------------------------------------------------------------
+
+func (d *rbdDriver) lockID(caller string) string {
+
+	if len(caller) > callerLength {
+		caller = caller[:callerLength]
+	}
+
+	if caller == "" {
+		caller = "-"
+	}
+
+	return strings.Join([]string{lockPrefix, d.hostname, d.instance, caller}, lockSep)
+}
+
+//-----------------------------------------------------------------------------
+// ours tells whether the lock was taken by this driver, on any host.
+//-----------------------------------------------------------------------------
+
+func (h lockHolder) ours() bool {
+	return h.id == lockPrefix || strings.HasPrefix(h.id, lockPrefix+lockSep)
+}
+
+//-----------------------------------------------------------------------------
+// host returns the host encoded in the lock ID, if any.
+//-----------------------------------------------------------------------------
+
+func (h lockHolder) host() string {
+	if f := strings.SplitN(h.id, lockSep, 4); len(f) == 4 {
+		return f[1]
+	}
+	return ""
+}
+
+//-----------------------------------------------------------------------------
+// String describes the holder as caller@host (instance, locker address).
+//-----------------------------------------------------------------------------
+
+func (h lockHolder) String() string {
+
+	who := h.locker + " " + h.address
+	f := strings.SplitN(h.id, lockSep, 4)
+	if len(f) != 4 {
+		return who
+	}
+
+	return f[3] + "@" + f[1] + " (instance " + f[2] + ", " + who + ")"
+}
+
+//-----------------------------------------------------------------------------
+// imageLocks returns the locks taken by this driver on the image.
+//-----------------------------------------------------------------------------
+
+func (d *rbdDriver) imageLocks(cl *cluster, pool, name string) ([]lockHolder, error) {
+
+	locks, err := cl.rbd.listLocks(pool, name)
+	if err != nil {
+		return nil, err
+	}
+
+	ours := []lockHolder{}
+	for _, l := range locks {
+		if l.ours() {
+			ours = append(ours, l)
+		}
+	}
+
+	return ours, nil
+}
+
+//-----------------------------------------------------------------------------
+// holders joins the description of the locks.
+//-----------------------------------------------------------------------------
+
+func holders(locks []lockHolder) string {
+	list := []string{}
+	for _, l := range locks {
+		list = append(list, l.String())
+	}
+	return strings.Join(list, ", ")
+}
+
+//-----------------------------------------------------------------------------
+// Interfaces definitions:
+//-----------------------------------------------------------------------------
+
+// lockStrategy guards an image against concurrent use from several hosts.
+type lockStrategy interface {
+	acquire(cl *cluster, pool, name, caller string, wait time.Duration) (string, string, error)
+	release(cl *cluster, pool, name, lockID, locker string) error
+	mapOpts(format bool) mapOpts
+	features() []string
+}
+
+//-----------------------------------------------------------------------------
+// advisoryLock takes an RBD lock that every host of this driver honors.
+//-----------------------------------------------------------------------------
+
+type advisoryLock struct {
+	d *rbdDriver
+}
+
+func (s advisoryLock) acquire(cl *cluster, pool, name, caller string, wait time.Duration) (string, string, error) {
+	return s.d.lockImage(cl, pool, name, caller, wait)
+}
+
+func (s advisoryLock) release(cl *cluster, pool, name, lockID, locker string) error {
+	if locker == "" {
+		log.Printf("[Lock] WARN image %s/%s/%s has no known lock", cl.name, pool, name)
+		return nil
+	}
+	return cl.rbd.unlockImage(pool, name, lockID, locker)
+}
+
+func (s advisoryLock) mapOpts(format bool) mapOpts {
+	return mapOpts{}
+}
+
+func (s advisoryLock) features() []string {
+	return nil
+}
+
+//-----------------------------------------------------------------------------
+// exclusiveLock maps the image with the exclusive option, the client then
+// holds the exclusive-lock of the image until it is unmapped.
+//-----------------------------------------------------------------------------
+
+type exclusiveLock struct{}
+
+func (s exclusiveLock) acquire(cl *cluster, pool, name, caller string, wait time.Duration) (string, string, error) {
+
+	info, err := cl.rbd.infoImage(pool, name)
+	if err != nil {
+		return "", "", err
+	}
+
+	for _, f := range info.features {
+		if f == "exclusive-lock" {
+			return "", "", nil
+		}
+	}
+
+	return "", "", errors.New("Image " + cl.name + "/" + pool + "/" + name + " lacks the exclusive-lock feature")
+}
+
+func (s exclusiveLock) release(cl *cluster, pool, name, lockID, locker string) error {
+	return nil
+}
+
+func (s exclusiveLock) mapOpts(format bool) mapOpts {
+	return mapOpts{exclusive: true}
+}
+
+func (s exclusiveLock) features() []string {
+	return []string{"exclusive-lock"}
+}
+
+//-----------------------------------------------------------------------------
+// noLock takes no lock and maps read-only, so any number of hosts can mount
+// the image. Only formatting maps it read-write.
+//-----------------------------------------------------------------------------
+
+type noLock struct{}
+
+func (s noLock) acquire(cl *cluster, pool, name, caller string, wait time.Duration) (string, string, error) {
+	return "", "", nil
+}
+
+func (s noLock) release(cl *cluster, pool, name, lockID, locker string) error {
+	return nil
+}
+
+func (s noLock) mapOpts(format bool) mapOpts {
+	return mapOpts{readOnly: !format}
+}
+
+func (s noLock) features() []string {
+	return nil
+}
+
+//-----------------------------------------------------------------------------
+// strategyFor returns the locking strategy by name.
+//-----------------------------------------------------------------------------
+
+func (d *rbdDriver) strategyFor(locking string) (lockStrategy, error) {
+
+	switch locking {
+	case lockingAdvisory:
+		return advisoryLock{d: d}, nil
+	case lockingExclusive:
+		return exclusiveLock{}, nil
+	case lockingNone:
+		return noLock{}, nil
+	}
+
+	return nil, errors.New("Unknown locking strategy: " + locking)
+}
+
+//-----------------------------------------------------------------------------
+// imageLocking returns the locking strategy stored with the image or the
+// default.
+//-----------------------------------------------------------------------------
+
+func (d *rbdDriver) imageLocking(cl *cluster, pool, name string) string {
+
+	if locking, err := cl.rbd.getImageMeta(pool, name, metaLocking); err == nil && locking != "" {
+		return locking
+	}
+
+	return d.defLocking
+}
+
+//-----------------------------------------------------------------------------
+// recordClient stores with the image the address of the client that mapped
+// it, found as the new watcher. The lock holder address is the short lived
+// rbd lock add process, so fencing needs the mapping client instead.
+//-----------------------------------------------------------------------------
+
+func (d *rbdDriver) recordClient(cl *cluster, pool, name, lockID string, before []string) error {
+
+	after, err := cl.rbd.listWatchers(pool, name)
+	if err != nil {
+		return err
+	}
+
+	known := map[string]bool{}
+	for _, w := range before {
+		known[w] = true
+	}
+
+	clients := []string{}
+	for _, w := range after {
+		if !known[w] {
+			clients = append(clients, w)
+		}
+	}
+
+	if len(clients) == 0 {
+		return errors.New("Unable to identify the client mapping " + cl.name + "/" + pool + "/" + name)
+	}
+
+	value := strings.Join(append([]string{lockID}, clients...), " ")
+	return cl.rbd.setImageMeta(pool, name, metaClient, value)
+}
+
+//-----------------------------------------------------------------------------
+// forgetClient removes the recorded client of the image.
+//-----------------------------------------------------------------------------
+
+func (d *rbdDriver) forgetClient(cl *cluster, pool, name string) error {
+	return cl.rbd.removeImageMeta(pool, name, metaClient)
+}
+
+//-----------------------------------------------------------------------------
+// lockClients returns the exact addresses of the clients of the locks: the
+// lock holders and their recorded mapping clients. It refuses locks of this
+// host and locks whose mapping client is unknown.
+//-----------------------------------------------------------------------------
+
+func (d *rbdDriver) lockClients(cl *cluster, pool, name string, locks []lockHolder) ([]string, error) {
+
+	for _, h := range locks {
+		if h.host() == d.hostname {
+			return nil, errors.New("Lock " + h.String() + " belongs to this host, remove it by hand if it is stale")
+		}
+	}
+
+	value, err := cl.rbd.getImageMeta(pool, name, metaClient)
+	f := strings.Fields(value)
+	if err != nil || len(f) < 2 || len(locks) != 1 || f[0] != locks[0].id {
+		return nil, errors.New("Unknown mapping client of " + holders(locks))
+	}
+
+	return append([]string{locks[0].address}, f[1:]...), nil
+}
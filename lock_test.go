@@ -0,0 +1,191 @@
+//-----------------------------------------------------------------------------
+// Package membership:
+//-----------------------------------------------------------------------------
+
+package main
+
+//-----------------------------------------------------------------------------
+// Imports:
+//-----------------------------------------------------------------------------
+
+import (
+
+	// Standard library:
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	// Community:
+	dkvolume "github.com/docker/go-plugins-helpers/volume"
+)
+
+//-----------------------------------------------------------------------------
+// Package constant declarations factored into a block:
+//-----------------------------------------------------------------------------
+
+const (
+	staleID     = "dockerLock:node2:9f8e7d6c:abcdef012345"
+	staleClient = "10.0.0.2:0/777"
+)
+
+//-----------------------------------------------------------------------------
+// TestLockHolder
+//-----------------------------------------------------------------------------
+
+func TestLockHolder(t *testing.T) {
+
+	d, _ := newTestDriver(t)
+
+	id := d.lockID("b87d7442095999a92b65b3d9691e697b")
+	if id != "dockerLock:node1:0a1b2c3d:b87d74420959" {
+		t.Errorf("lockID is %s", id)
+	}
+
+	h := lockHolder{id: id, locker: "client.4235", address: "10.0.0.1:0/1"}
+	if !h.ours() || h.host() != "node1" {
+		t.Errorf("%s is ours %v on host %q", h, h.ours(), h.host())
+	}
+
+	if want := "b87d74420959@node1 (instance 0a1b2c3d, client.4235 10.0.0.1:0/1)"; h.String() != want {
+		t.Errorf("holder is %q, want %q", h.String(), want)
+	}
+
+	// Older versions used a bare prefix, other tools anything
+	for id, ours := range map[string]bool{lockPrefix: true, "kubelet_lock_magic_node2": false} {
+		if h := (lockHolder{id: id}); h.ours() != ours || h.host() != "" {
+			t.Errorf("%s is ours %v on host %q", id, h.ours(), h.host())
+		}
+	}
+}
+
+//-----------------------------------------------------------------------------
+// TestTakeover mounts an image locked by another host with takeover enabled.
+// Only a lock whose recorded mapping client is gone, and whose lease expired
+// or that stayed unwatched for the grace period, is fenced and taken over.
+//-----------------------------------------------------------------------------
+
+func TestTakeover(t *testing.T) {
+
+	for _, c := range []struct {
+		name  string
+		setup func(d *rbdDriver, f *fakeCeph, img *fakeImage)
+		taken bool
+	}{
+		{"expired lease", func(d *rbdDriver, f *fakeCeph, img *fakeImage) {
+			img.meta[metaLease] = lease{lockID: staleID, expiry: time.Now().Add(-time.Minute)}.String()
+			d.grace = time.Hour
+		}, true},
+
+		{"no lease after the grace period", func(d *rbdDriver, f *fakeCeph, img *fakeImage) {
+		}, true},
+
+		{"lease of an older lock", func(d *rbdDriver, f *fakeCeph, img *fakeImage) {
+			img.meta[metaLease] = lease{lockID: "dockerLock:node3:00000000:-", expiry: time.Now().Add(time.Minute)}.String()
+		}, true},
+
+		{"holder client watching", func(d *rbdDriver, f *fakeCeph, img *fakeImage) {
+			img.watchers = []string{"10.0.0.2:0/778", staleClient}
+		}, false},
+
+		{"holder client watching with an expired lease", func(d *rbdDriver, f *fakeCeph, img *fakeImage) {
+			img.meta[metaLease] = lease{lockID: staleID, expiry: time.Now().Add(-time.Minute)}.String()
+			img.watchers = []string{staleClient}
+		}, false},
+
+		{"valid lease", func(d *rbdDriver, f *fakeCeph, img *fakeImage) {
+			img.meta[metaLease] = lease{lockID: staleID, expiry: time.Now().Add(time.Minute)}.String()
+		}, false},
+
+		{"lock of this host", func(d *rbdDriver, f *fakeCeph, img *fakeImage) {
+			img.locks[0].id = "dockerLock:node1:0badf00d:abcdef012345"
+			img.meta[metaClient] = img.locks[0].id + " " + staleClient
+		}, false},
+
+		{"unknown mapping client", func(d *rbdDriver, f *fakeCeph, img *fakeImage) {
+			delete(img.meta, metaClient)
+		}, false},
+
+		{"mapping client of another lock", func(d *rbdDriver, f *fakeCeph, img *fakeImage) {
+			img.meta[metaClient] = "dockerLock:node3:00000000:- " + staleClient
+		}, false},
+
+		{"lock changing hands during the grace period", func(d *rbdDriver, f *fakeCeph, img *fakeImage) {
+			// Listed by lockImage, before and after the grace period
+			f.hook("locks", func(n int) {
+				if n == 3 {
+					img.locks = []lockHolder{{id: "dockerLock:node3:00000000:-", locker: "client.900", address: "10.0.0.3:0/900"}}
+				}
+			})
+		}, false},
+
+		{"takeover disabled", func(d *rbdDriver, f *fakeCeph, img *fakeImage) {
+			img.meta[metaLease] = lease{lockID: staleID, expiry: time.Now().Add(-time.Minute)}.String()
+			d.takeover = false
+		}, false},
+	} {
+		d, f := newTestDriver(t)
+		d.takeover = true
+		d.grace = 10 * time.Millisecond
+
+		img := f.addImage("rbd", "data", "xfs")
+		f.addLock("rbd", "data", staleID)
+		img.meta[metaClient] = staleID + " " + staleClient
+		c.setup(d, f, img)
+
+		holder := img.locks[0]
+		r := d.Mount(dkvolume.MountRequest{Name: "data", ID: "c1"})
+
+		if !c.taken {
+			if r.Err == "" {
+				t.Errorf("%s: Mount took the lock over", c.name)
+			}
+			if len(f.fenced) > 0 {
+				t.Errorf("%s: Mount fenced %v", c.name, f.fenced)
+			}
+			if len(img.locks) != 1 || strings.HasPrefix(img.locks[0].id, "dockerLock:node1:0a1b2c3d:") {
+				t.Errorf("%s: Mount left the locks %v", c.name, img.locks)
+			}
+			continue
+		}
+
+		if r.Err != "" {
+			t.Errorf("%s: Mount: %s", c.name, r.Err)
+			continue
+		}
+
+		// The lock holder and its mapping client, fenced before unlocking
+		if want := []string{holder.address, staleClient}; !reflect.DeepEqual(f.fenced, want) {
+			t.Errorf("%s: Mount fenced %v, want %v", c.name, f.fenced, want)
+		}
+
+		if len(img.locks) != 1 || !strings.HasPrefix(img.locks[0].id, "dockerLock:node1:0a1b2c3d:") {
+			t.Errorf("%s: Mount left the locks %v", c.name, img.locks)
+		}
+	}
+}
+
+//-----------------------------------------------------------------------------
+// TestTakeoverFenceFailure checks that a lock is kept if its client cannot be
+// blocklisted.
+//-----------------------------------------------------------------------------
+
+func TestTakeoverFenceFailure(t *testing.T) {
+
+	d, f := newTestDriver(t)
+	d.takeover = true
+
+	img := f.addImage("rbd", "data", "xfs")
+	f.addLock("rbd", "data", staleID)
+	img.meta[metaClient] = staleID + " " + staleClient
+	img.meta[metaLease] = lease{lockID: staleID, expiry: time.Now().Add(-time.Minute)}.String()
+	f.fail("blocklist")
+
+	if r := d.Mount(dkvolume.MountRequest{Name: "data", ID: "c1"}); r.Err == "" {
+		t.Fatal("Mount took the lock over without fencing")
+	}
+
+	if len(img.locks) != 1 || img.locks[0].id != staleID {
+		t.Errorf("Mount left the locks %v", img.locks)
+	}
+}
@@ -25,7 +25,11 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
 
 	// Community:
 	dkvolume "github.com/docker/go-plugins-helpers/volume"
@@ -49,11 +53,41 @@ var (
 	// Predefined defaults:
 	defVolRoot = filepath.Join(dkvolume.DefaultDockerRootDirectory, id)
 
+	// Cluster profiles from the config file:
+	profiles = map[string]clusterConfig{}
+
 	// Flags:
 	volRoot   = flag.String("volroot", defVolRoot, "Docker volumes root directory")
 	defPool   = flag.String("pool", "rbd", "Default Ceph pool for RBD operations")
 	defSize   = flag.Int("size", 2048, "Default block device image size")
 	defFsType = flag.String("fsType", "xfs", "Default file system type for new images")
+	pools     = flag.String("pools", "", "Comma separated list of additional managed pools")
+	ownedOnly = flag.Bool("ownedOnly", false, "List only images created by this driver")
+	remove    = flag.String("remove", "delete", "Remove policy: delete, keep or rename")
+	purge     = flag.Bool("purgeSnaps", false, "Purge image snapshots when deleting")
+	config    = flag.String("config", "", "JSON config file with flag names as keys and cluster profiles")
+
+	// Ceph connection flags for the default cluster:
+	cephName = flag.String("cluster", "", "Ceph cluster name, also the default cluster profile name")
+	client   = flag.String("id", "", "Ceph client ID used for authentication")
+	keyring  = flag.String("keyring", "", "Ceph keyring file")
+	keyfile  = flag.String("keyfile", "", "File containing the Ceph secret key")
+	conf     = flag.String("conf", "", "Ceph configuration file")
+	mon      = flag.String("mon", "", "Comma separated list of Ceph monitor addresses")
+	mapWith  = flag.String("mapper", "cli", "How to map images: cli (rbd map) or sysfs")
+	sysRoot  = flag.String("sysfs", "/sys", "Root of the sysfs tree used by the sysfs mapper")
+	mapMode  = flag.String("mapping", "krbd", "Default mapping mode: krbd (kernel) or nbd (rbd-nbd)")
+	locking  = flag.String("locking", "advisory", "Default locking strategy: advisory (rbd lock), exclusive (exclusive-lock feature) or none (read-only mounts)")
+	features = flag.String("krbdFeatures", "", "Comma separated list of image features supported by krbd, empty to skip the check and use the cluster defaults")
+	fixFeat  = flag.Bool("fixFeatures", false, "Disable image features not supported by krbd before mapping")
+	timeout  = flag.Duration("timeout", time.Minute, "Default deadline for every external command")
+	timeouts = flag.String("timeouts", "", "Per-operation deadlines, as in map=2m,mkfs=10m")
+	takeover = flag.Bool("takeover", false, "Take over locks whose mapping client has not watched the image for the grace period, blocklisting that client")
+	grace    = flag.Duration("takeoverGrace", 30*time.Second, "Grace period before taking over a stale lock")
+	leaseTTL = flag.Duration("leaseTTL", time.Minute, "Lease renewed while a volume is mounted, other hosts may take over an expired one (0 disables)")
+	stopWait = flag.Duration("shutdownTimeout", 30*time.Second, "How long to drain requests and release volumes on SIGTERM or SIGINT")
+	release  = flag.Bool("releaseOnExit", false, "Unmount, unmap and unlock every volume on exit, even if containers still use it")
+	lockWait = flag.Duration("lockWait", 0, "How long Mount waits for a locked image, unless set with the lock-wait option")
 )
 
 //-----------------------------------------------------------------------------
@@ -72,9 +106,8 @@ func init() {
 	// Change the flags on the default logger:
 	log.SetFlags(log.LstdFlags | log.Lshortfile)
 
-	// Parse commandline flags:
+	// Report the usage on bad flags:
 	flag.Usage = usage
-	flag.Parse()
 }
 
 //-----------------------------------------------------------------------------
@@ -87,16 +120,99 @@ func usage() {
 	os.Exit(2)
 }
 
+//-----------------------------------------------------------------------------
+// func splitList() splits a comma separated flag dropping empty items:
+//-----------------------------------------------------------------------------
+
+func splitList(s string) []string {
+	list := []string{}
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
 //-----------------------------------------------------------------------------
 // Function main of package main:
 //-----------------------------------------------------------------------------
 
 func main() {
 
-	// Request handler with a driver implementation
+	// Parse commandline flags, in main so that tests can run their own:
+	flag.Parse()
+
+	// Load the config file:
+	if *config != "" {
+		var err error
+		if profiles, err = loadConfig(*config); err != nil {
+			log.Fatalf("[Init] ERROR %s", err)
+		}
+	}
+
 	log.Printf("[Init] INFO volume root is %s\n", *volRoot)
-	d := initDriver(*volRoot, *defPool, *defFsType, *defSize)
-	h := dkvolume.NewHandler(&d)
+
+	// The default cluster profile comes from the flags
+	defCluster := *cephName
+	if defCluster == "" {
+		defCluster = "ceph"
+	}
+
+	if _, found := profiles[defCluster]; found {
+		log.Fatalf("[Init] ERROR cluster profile %s duplicates the default cluster", defCluster)
+	}
+
+	profiles[defCluster] = clusterConfig{
+		Cluster: *cephName,
+		ID:      *client,
+		Keyring: *keyring,
+		Keyfile: *keyfile,
+		Conf:    *conf,
+		Mon:     *mon,
+		Pool:    *defPool,
+		Pools:   splitList(*pools),
+		Mapper:  *mapWith,
+	}
+
+	r, err := newRunner(*timeout, *timeouts)
+	if err != nil {
+		log.Fatalf("[Init] ERROR %s", err)
+	}
+
+	// Request handler with a driver implementation
+	d := initDriver(driverOpts{
+		volRoot:    *volRoot,
+		sysfsRoot:  *sysRoot,
+		defFsType:  *defFsType,
+		defSize:    *defSize,
+		profiles:   profiles,
+		defCluster: defCluster,
+		defMapping: *mapMode,
+		defLocking: *locking,
+		runner:     r,
+		features:   splitList(*features),
+		fixFeat:    *fixFeat,
+		ownedOnly:  *ownedOnly,
+		remove:     *remove,
+		purgeSnaps: *purge,
+		takeover:   *takeover,
+		grace:      *grace,
+		lockWait:   *lockWait,
+		leaseTTL:   *leaseTTL,
+	})
+	h := dkvolume.NewHandler(d)
+
+	// Shut down gracefully on SIGTERM and SIGINT
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+	go func() {
+		sig := <-signals
+		log.Printf("[Shutdown] INFO received %s", sig)
+		d.shutdown(*stopWait, *release)
+		os.Remove(socket)
+		os.Exit(0)
+	}()
 
 	// Listen for requests in a unix socket:
 	log.Printf("[Init] INFO listening on %s\n", socket)
@@ -0,0 +1,101 @@
+//-----------------------------------------------------------------------------
+// Package membership:
+//-----------------------------------------------------------------------------
+
+package main
+
+//-----------------------------------------------------------------------------
+// Imports:
+//-----------------------------------------------------------------------------
+
+import (
+
+	// Standard library:
+	"errors"
+	"os/exec"
+	"strings"
+)
+
+//-----------------------------------------------------------------------------
+// Structs definitions:
+//-----------------------------------------------------------------------------
+
+// nbdCLI implements mapper with rbd-nbd, which maps images through librbd in
+// user space and so supports every image feature.
+type nbdCLI struct {
+	cmd    map[string]string
+	conn   cephConn
+	runner *runner
+}
+
+//-----------------------------------------------------------------------------
+// newNBDCLI
+//-----------------------------------------------------------------------------
+
+func newNBDCLI(cmd map[string]string, conn cephConn, r *runner) *nbdCLI {
+	return &nbdCLI{cmd: cmd, conn: conn, runner: r}
+}
+
+//-----------------------------------------------------------------------------
+// command builds an rbd-nbd invocation with the cluster connection options.
+//-----------------------------------------------------------------------------
+
+func (c *nbdCLI) command(args ...string) *exec.Cmd {
+	return exec.Command(c.cmd["rbd-nbd"], append(c.conn.args(), args...)...)
+}
+
+//-----------------------------------------------------------------------------
+// mapImage
+//-----------------------------------------------------------------------------
+
+func (c *nbdCLI) mapImage(pool, name string, opts mapOpts) (string, error) {
+
+	// Map the image to a network block device
+	out, err := c.runner.run("map", "Unable to map the image to a network block device", c.command(
+		append([]string{"map", pool + "/" + name}, opts.args()...)...,
+	))
+	if err != nil {
+		return "", err
+	}
+
+	// Parse the device
+	device := strings.TrimSpace(string(out))
+	if !strings.HasPrefix(device, "/dev/nbd") {
+		return "", errors.New("Unable to parse the network block device: " + device)
+	}
+
+	return device, nil
+}
+
+//-----------------------------------------------------------------------------
+// unmapImage
+//-----------------------------------------------------------------------------
+
+func (c *nbdCLI) unmapImage(device string) error {
+
+	// Unmap the image from a network block device
+	if _, err := c.runner.run("unmap", "Unable to unmap the image from "+device, c.command("unmap", device)); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+//-----------------------------------------------------------------------------
+// showMapped returns the images mapped to network block devices indexed by
+// device.
+//-----------------------------------------------------------------------------
+
+func (c *nbdCLI) showMapped() (map[string]mapping, error) {
+
+	// List the mapped images
+	out, err := c.runner.run("list", "Unable to list the mapped images", c.command(
+		"list-mapped", "--format", "json",
+	))
+
+	if err != nil {
+		return nil, err
+	}
+
+	return parseMapped(out)
+}
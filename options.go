@@ -0,0 +1,166 @@
+//-----------------------------------------------------------------------------
+// Package membership:
+//-----------------------------------------------------------------------------
+
+package main
+
+//-----------------------------------------------------------------------------
+// Imports:
+//-----------------------------------------------------------------------------
+
+import (
+
+	// Standard library:
+	"errors"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//-----------------------------------------------------------------------------
+// Package variable declarations factored into a block:
+//-----------------------------------------------------------------------------
+
+var (
+	sizeRegex   = regexp.MustCompile(`^([0-9]+)([MGT]?)B?$`)
+	fsTypeRegex = regexp.MustCompile(`^[[:alnum:]]+$`)
+	mntOptRegex = regexp.MustCompile(`^[-_=.,:/[:alnum:]]+$`)
+	poolRegex   = regexp.MustCompile(`^[-_.[:alnum:]]+$`)
+)
+
+//-----------------------------------------------------------------------------
+// Structs definitions:
+//-----------------------------------------------------------------------------
+
+type imageOpts struct {
+	cluster  *cluster
+	pool     string
+	size     int
+	fstype   string
+	mkfsOpts string
+	mntOpts  string
+	mapping  string
+	lockWait string
+	locking  string
+
+	// Not persisted:
+	forceFormat bool
+}
+
+//-----------------------------------------------------------------------------
+// parseOpts validates the driver options passed in a Create request. Values
+// found in the volume name are used unless overwritten by an option.
+//-----------------------------------------------------------------------------
+
+func (d *rbdDriver) parseOpts(cl *cluster, pool string, size int, opts map[string]string) (*imageOpts, error) {
+
+	// Set defaults
+	o := &imageOpts{
+		cluster: cl,
+		pool:    pool,
+		size:    size,
+		fstype:  d.defFsType,
+		mapping: d.defMapping,
+		locking: d.defLocking,
+	}
+
+	unknown := []string{}
+
+	for key, value := range opts {
+		switch key {
+
+		case "size":
+			sub := sizeRegex.FindStringSubmatch(strings.ToUpper(value))
+			if len(sub) != 3 {
+				return nil, errors.New("Invalid size option: " + value)
+			}
+			n, err := strconv.Atoi(sub[1])
+			if err != nil || n <= 0 {
+				return nil, errors.New("Invalid size option: " + value)
+			}
+			switch sub[2] {
+			case "G":
+				n *= 1024
+			case "T":
+				n *= 1024 * 1024
+			}
+			o.size = n
+
+		case "fstype":
+			if !fsTypeRegex.MatchString(value) {
+				return nil, errors.New("Invalid fstype option: " + value)
+			}
+			o.fstype = value
+
+		case "pool":
+			if !poolRegex.MatchString(value) {
+				return nil, errors.New("Invalid pool option: " + value)
+			}
+			o.pool = value
+
+		case "cluster":
+			c, found := d.clusters[value]
+			if !found {
+				return nil, errors.New("Unknown cluster option: " + value)
+			}
+			o.cluster = c
+
+		case "mkfsopts":
+			o.mkfsOpts = value
+
+		case "mntopts":
+			if !mntOptRegex.MatchString(value) {
+				return nil, errors.New("Invalid mntopts option: " + value)
+			}
+			o.mntOpts = value
+
+		case "mapping":
+			if value != mappingKRBD && value != mappingNBD {
+				return nil, errors.New("Invalid mapping option: " + value)
+			}
+			o.mapping = value
+
+		case "locking":
+			if _, err := d.strategyFor(value); err != nil {
+				return nil, errors.New("Invalid locking option: " + value)
+			}
+			o.locking = value
+
+		case "lock-wait":
+			if wait, err := time.ParseDuration(value); err != nil || wait < 0 {
+				return nil, errors.New("Invalid lock-wait option: " + value)
+			}
+			o.lockWait = value
+
+		case "force-format":
+			force, err := strconv.ParseBool(value)
+			if err != nil {
+				return nil, errors.New("Invalid force-format option: " + value)
+			}
+			o.forceFormat = force
+
+		default:
+			unknown = append(unknown, key)
+		}
+	}
+
+	// Report every unknown option at once
+	if len(unknown) > 0 {
+		sort.Strings(unknown)
+		return nil, errors.New("Unknown options: " + strings.Join(unknown, ", "))
+	}
+
+	// Another cluster brings its own default pool
+	if _, found := opts["pool"]; !found && o.cluster != cl {
+		o.pool = o.cluster.defPool
+	}
+
+	// Only the pool option is checked, names may use any pool
+	if _, found := opts["pool"]; found && !o.cluster.isManaged(o.pool) {
+		return nil, errors.New("Pool " + o.pool + " is not managed in cluster " + o.cluster.name)
+	}
+
+	return o, nil
+}
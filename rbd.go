@@ -0,0 +1,463 @@
+//-----------------------------------------------------------------------------
+// Package membership:
+//-----------------------------------------------------------------------------
+
+package main
+
+//-----------------------------------------------------------------------------
+// Imports:
+//-----------------------------------------------------------------------------
+
+import (
+
+	// Standard library:
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+//-----------------------------------------------------------------------------
+// Structs definitions:
+//-----------------------------------------------------------------------------
+
+// rbdCLI implements blockBackend and mapper with the rbd command line tool.
+type rbdCLI struct {
+	cmd    map[string]string
+	conn   cephConn
+	runner *runner
+}
+
+//-----------------------------------------------------------------------------
+// newRBDCLI
+//-----------------------------------------------------------------------------
+
+func newRBDCLI(cmd map[string]string, conn cephConn, r *runner) *rbdCLI {
+	return &rbdCLI{cmd: cmd, conn: conn, runner: r}
+}
+
+//-----------------------------------------------------------------------------
+// command builds an rbd invocation with the cluster connection options.
+//-----------------------------------------------------------------------------
+
+func (c *rbdCLI) command(args ...string) *exec.Cmd {
+	return exec.Command(c.cmd["rbd"], append(c.conn.args(), args...)...)
+}
+
+//-----------------------------------------------------------------------------
+// createImage
+//-----------------------------------------------------------------------------
+
+func (c *rbdCLI) createImage(pool, name string, size int, features []string) error {
+
+	// Only the given features, or the cluster defaults if none
+	args := []string{"create", "--pool", pool, "--size", strconv.Itoa(size)}
+	for _, f := range features {
+		args = append(args, "--image-feature", f)
+	}
+
+	// Create the image device
+	_, err := c.runner.run("create", "Unable to create the image device", c.command(append(args, name)...))
+
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+//-----------------------------------------------------------------------------
+// disableFeatures
+//-----------------------------------------------------------------------------
+
+func (c *rbdCLI) disableFeatures(pool, name string, features []string) error {
+
+	// Disable all of them at once to honor the dependencies
+	_, err := c.runner.run("feature", "Unable to disable the image features "+strings.Join(features, ", "), c.command(
+		append([]string{"feature", "disable", "--pool", pool, name}, features...)...,
+	))
+
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+//-----------------------------------------------------------------------------
+// lockImage
+//-----------------------------------------------------------------------------
+
+func (c *rbdCLI) lockImage(pool, name, lockID string) error {
+
+	// Lock the image
+	_, err := c.runner.run("lock", "Unable to lock the image", c.command(
+		"lock",
+		"add", "--pool", pool,
+		name, lockID,
+	))
+
+	if err != nil {
+		return lockError(err)
+	}
+
+	return nil
+}
+
+//-----------------------------------------------------------------------------
+// lockError marks a failed rbd lock add as errLocked when someone else holds
+// the lock. rbd exits with EBUSY or EEXIST and prints no errno then.
+//-----------------------------------------------------------------------------
+
+func lockError(err error) error {
+
+	e, ok := err.(*cmdError)
+	if ok && (e.code == 16 || e.code == 17 || strings.Contains(e.stderr, "already held")) {
+		e.kind = errLocked
+	}
+
+	return err
+}
+
+//-----------------------------------------------------------------------------
+// listImages
+//-----------------------------------------------------------------------------
+
+func (c *rbdCLI) listImages(pool string) ([]string, error) {
+
+	// List RBD images
+	out, err := c.runner.run("list", "Unable to list images", c.command(
+		"ls", "--format", "json", pool,
+	))
+
+	if err != nil {
+		return nil, err
+	}
+
+	return parseImages(out)
+}
+
+//-----------------------------------------------------------------------------
+// infoImage
+//-----------------------------------------------------------------------------
+
+func (c *rbdCLI) infoImage(pool, name string) (*imageInfo, error) {
+
+	// Show the image details
+	out, err := c.runner.run("info", "Unable to retrieve the image info", c.command(
+		"info", "--format", "json",
+		"--pool", pool, name,
+	))
+
+	if err != nil {
+		return nil, err
+	}
+
+	return parseInfo(out)
+}
+
+//-----------------------------------------------------------------------------
+// usageImage returns the bytes used by the image.
+//-----------------------------------------------------------------------------
+
+func (c *rbdCLI) usageImage(pool, name string) (uint64, error) {
+
+	// Show the image usage
+	out, err := c.runner.run("info", "Unable to retrieve the image usage", c.command(
+		"du", "--format", "json",
+		"--pool", pool, name,
+	))
+
+	if err != nil {
+		return 0, err
+	}
+
+	return parseUsage(out, name)
+}
+
+//-----------------------------------------------------------------------------
+// listSnapshots
+//-----------------------------------------------------------------------------
+
+func (c *rbdCLI) listSnapshots(pool, name string) ([]string, error) {
+
+	// List the image snapshots
+	out, err := c.runner.run("list", "Unable to list the image snapshots", c.command(
+		"snap", "ls", "--format", "json",
+		"--pool", pool, name,
+	))
+
+	if err != nil {
+		return nil, err
+	}
+
+	return parseSnapshots(out)
+}
+
+//-----------------------------------------------------------------------------
+// setImageMeta
+//-----------------------------------------------------------------------------
+
+func (c *rbdCLI) setImageMeta(pool, name, key, value string) error {
+
+	// Set the image metadata
+	_, err := c.runner.run("meta", "Unable to set the image metadata "+key, c.command(
+		"image-meta", "set",
+		"--pool", pool, name, key, value,
+	))
+
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+//-----------------------------------------------------------------------------
+// getImageMeta
+//-----------------------------------------------------------------------------
+
+func (c *rbdCLI) getImageMeta(pool, name, key string) (string, error) {
+
+	// Get the image metadata
+	out, err := c.runner.run("meta", "Unable to get the image metadata "+key, c.command(
+		"image-meta", "get",
+		"--pool", pool, name, key,
+	))
+
+	if err != nil {
+		return "", err
+	}
+
+	return strings.TrimSpace(string(out)), nil
+}
+
+//-----------------------------------------------------------------------------
+// removeImageMeta
+//-----------------------------------------------------------------------------
+
+func (c *rbdCLI) removeImageMeta(pool, name, key string) error {
+
+	// Remove the image metadata
+	_, err := c.runner.run("meta", "Unable to remove the image metadata "+key, c.command(
+		"image-meta", "remove",
+		"--pool", pool, name, key,
+	))
+
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+//-----------------------------------------------------------------------------
+// removeImage
+//-----------------------------------------------------------------------------
+
+func (c *rbdCLI) removeImage(pool, name string) error {
+
+	// Remove the image
+	_, err := c.runner.run("remove", "Unable to remove the image", c.command(
+		"rm",
+		"--pool", pool, name,
+	))
+
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+//-----------------------------------------------------------------------------
+// renameImage
+//-----------------------------------------------------------------------------
+
+func (c *rbdCLI) renameImage(pool, name, newName string) error {
+
+	// Rename the image
+	_, err := c.runner.run("rename", "Unable to rename the image", c.command(
+		"rename",
+		"--pool", pool, name, newName,
+	))
+
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+//-----------------------------------------------------------------------------
+// purgeSnapshots
+//-----------------------------------------------------------------------------
+
+func (c *rbdCLI) purgeSnapshots(pool, name string) error {
+
+	// Remove all the image snapshots
+	_, err := c.runner.run("snap", "Unable to purge the image snapshots", c.command(
+		"snap", "purge",
+		"--pool", pool, name,
+	))
+
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+//-----------------------------------------------------------------------------
+// listLocks
+//-----------------------------------------------------------------------------
+
+func (c *rbdCLI) listLocks(pool, name string) ([]lockHolder, error) {
+
+	// List the locks
+	out, err := c.runner.run("list", "Unable to list the image locks", c.command(
+		"lock", "list", "--format", "json",
+		"--pool", pool, name,
+	))
+
+	if err != nil {
+		return nil, err
+	}
+
+	return parseLocks(out)
+}
+
+//-----------------------------------------------------------------------------
+// listWatchers returns the addresses of the clients watching the image.
+//-----------------------------------------------------------------------------
+
+func (c *rbdCLI) listWatchers(pool, name string) ([]string, error) {
+
+	// Show the image status
+	out, err := c.runner.run("info", "Unable to retrieve the image watchers", c.command(
+		"status", "--format", "json",
+		"--pool", pool, name,
+	))
+
+	if err != nil {
+		return nil, err
+	}
+
+	return parseWatchers(out)
+}
+
+//-----------------------------------------------------------------------------
+// blocklistClient fences the client address in the OSD map. Releases before
+// Pacific only know the blacklist command.
+//-----------------------------------------------------------------------------
+
+func (c *rbdCLI) blocklistClient(address string) error {
+
+	// Blocklist the client
+	_, err := c.runner.run("fence", "Unable to blocklist "+address, exec.Command(
+		c.cmd["ceph"], append(c.conn.args(), "osd", "blocklist", "add", address)...,
+	))
+
+	if e, ok := err.(*cmdError); ok && e.kind != errTimeout {
+		_, err = c.runner.run("fence", "Unable to blacklist "+address, exec.Command(
+			c.cmd["ceph"], append(c.conn.args(), "osd", "blacklist", "add", address)...,
+		))
+	}
+
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+//-----------------------------------------------------------------------------
+// unlockImage
+//-----------------------------------------------------------------------------
+
+func (c *rbdCLI) unlockImage(pool, name, lockID, locker string) error {
+
+	// Unlock the image
+	_, err := c.runner.run("unlock", "Unable to unlock the image", c.command(
+		"lock", "remove",
+		"--pool", pool, name, lockID, locker,
+	))
+
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+//-----------------------------------------------------------------------------
+// mapImage
+//-----------------------------------------------------------------------------
+
+func (c *rbdCLI) mapImage(pool, name string, opts mapOpts) (string, error) {
+
+	// Map the image to a kernel device
+	out, err := c.runner.run("map", "Unable to map the image to a kernel device", c.command(
+		append([]string{"map", "--pool", pool, name}, opts.args()...)...,
+	))
+
+	if err != nil {
+		return "", err
+	}
+
+	// Parse the device
+	return strings.TrimSpace(string(out)), nil
+}
+
+//-----------------------------------------------------------------------------
+// showMapped returns the images mapped to kernel devices indexed by device.
+//-----------------------------------------------------------------------------
+
+func (c *rbdCLI) showMapped() (map[string]mapping, error) {
+
+	// List the mapped images
+	out, err := c.runner.run("list", "Unable to list the mapped images", c.command(
+		"showmapped", "--format", "json",
+	))
+
+	if err != nil {
+		return nil, err
+	}
+
+	return parseMapped(out)
+}
+
+//-----------------------------------------------------------------------------
+// unmapImage
+//-----------------------------------------------------------------------------
+
+func (c *rbdCLI) unmapImage(device string) error {
+
+	// Unmap the image from a kernel device
+	_, err := c.runner.run("unmap", "Unable to unmap the image from "+device, c.command(
+		"unmap", device,
+	))
+
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+//-----------------------------------------------------------------------------
+// args returns the map options understood by rbd and rbd-nbd.
+//-----------------------------------------------------------------------------
+
+func (o mapOpts) args() []string {
+
+	args := []string{}
+	if o.exclusive {
+		args = append(args, "--exclusive")
+	}
+
+	if o.readOnly {
+		args = append(args, "--read-only")
+	}
+
+	return args
+}
@@ -0,0 +1,296 @@
+//-----------------------------------------------------------------------------
+// Package membership:
+//-----------------------------------------------------------------------------
+
+package main
+
+//-----------------------------------------------------------------------------
+// Imports:
+//-----------------------------------------------------------------------------
+
+import (
+
+	// Standard library:
+	"bytes"
+	"encoding/json"
+	"errors"
+)
+
+//-----------------------------------------------------------------------------
+// Structs definitions:
+//-----------------------------------------------------------------------------
+
+// rbdInfoJSON is the output of rbd info --format json.
+type rbdInfoJSON struct {
+	Name     string   `json:"name"`
+	Size     uint64   `json:"size"`
+	Features []string `json:"features"`
+}
+
+// rbdLockJSON is an entry of rbd lock list --format json. Releases before
+// Nautilus print an object keyed by the lock ID, later ones an array.
+type rbdLockJSON struct {
+	ID      string `json:"id"`
+	Locker  string `json:"locker"`
+	Address string `json:"address"`
+}
+
+// rbdStatusJSON is the output of rbd status --format json. Some releases
+// print the watchers as an object.
+type rbdStatusJSON struct {
+	Watchers json.RawMessage `json:"watchers"`
+}
+
+// rbdWatcherJSON is a watcher of rbd status --format json.
+type rbdWatcherJSON struct {
+	Address string `json:"address"`
+	Client  uint64 `json:"client"`
+}
+
+// rbdMappedJSON is an entry of rbd showmapped --format json and rbd-nbd
+// list-mapped --format json. Releases before Nautilus print an object keyed
+// by the device ID, later ones an array. rbd-nbd calls the name image.
+type rbdMappedJSON struct {
+	Pool   string `json:"pool"`
+	Name   string `json:"name"`
+	Image  string `json:"image"`
+	Snap   string `json:"snap"`
+	Device string `json:"device"`
+}
+
+// rbdDuJSON is the output of rbd du --format json.
+type rbdDuJSON struct {
+	Images []struct {
+		Name        string `json:"name"`
+		Snapshot    string `json:"snapshot"`
+		Provisioned uint64 `json:"provisioned_size"`
+		Used        uint64 `json:"used_size"`
+	} `json:"images"`
+}
+
+// rbdSnapJSON is an entry of rbd snap ls --format json.
+type rbdSnapJSON struct {
+	ID   uint64 `json:"id"`
+	Name string `json:"name"`
+	Size uint64 `json:"size"`
+}
+
+//-----------------------------------------------------------------------------
+// decodeList decodes either an array or an object of entries. Object keys are
+// passed to setKey for formats that keep the ID out of the entry, in output
+// order. Objects are walked token by token since releases before Nautilus
+// repeat keys, as in one "watcher" key per watcher. Empty output is an empty
+// list.
+//-----------------------------------------------------------------------------
+
+func decodeList(out []byte, entries interface{}, setKey func(key string, raw json.RawMessage) error) error {
+
+	out = bytes.TrimSpace(out)
+	if len(out) == 0 {
+		return nil
+	}
+
+	// Array format
+	if out[0] == '[' {
+		return json.Unmarshal(out, entries)
+	}
+
+	// Object format
+	dec := json.NewDecoder(bytes.NewReader(out))
+	if tok, err := dec.Token(); err != nil {
+		return err
+	} else if tok != json.Delim('{') {
+		return errors.New("Expected a JSON array or object")
+	}
+
+	for dec.More() {
+
+		tok, err := dec.Token()
+		if err != nil {
+			return err
+		}
+
+		var raw json.RawMessage
+		if err = dec.Decode(&raw); err != nil {
+			return err
+		}
+
+		if err = setKey(tok.(string), raw); err != nil {
+			return err
+		}
+	}
+
+	_, err := dec.Token()
+	return err
+}
+
+//-----------------------------------------------------------------------------
+// parseImages
+//-----------------------------------------------------------------------------
+
+func parseImages(out []byte) ([]string, error) {
+
+	images := []string{}
+	if len(bytes.TrimSpace(out)) == 0 {
+		return images, nil
+	}
+
+	if err := json.Unmarshal(out, &images); err != nil {
+		return nil, errors.New("Unable to parse the image list: " + err.Error())
+	}
+
+	return images, nil
+}
+
+//-----------------------------------------------------------------------------
+// parseInfo
+//-----------------------------------------------------------------------------
+
+func parseInfo(out []byte) (*imageInfo, error) {
+
+	var j rbdInfoJSON
+	if err := json.Unmarshal(out, &j); err != nil {
+		return nil, errors.New("Unable to parse the image info: " + err.Error())
+	}
+
+	return &imageInfo{size: j.Size, features: j.Features}, nil
+}
+
+//-----------------------------------------------------------------------------
+// parseLocks
+//-----------------------------------------------------------------------------
+
+func parseLocks(out []byte) ([]lockHolder, error) {
+
+	entries := []rbdLockJSON{}
+	err := decodeList(out, &entries, func(key string, raw json.RawMessage) error {
+		var l rbdLockJSON
+		if err := json.Unmarshal(raw, &l); err != nil {
+			return err
+		}
+		l.ID = key
+		entries = append(entries, l)
+		return nil
+	})
+
+	if err != nil {
+		return nil, errors.New("Unable to parse the image locks: " + err.Error())
+	}
+
+	locks := []lockHolder{}
+	for _, l := range entries {
+		locks = append(locks, lockHolder{id: l.ID, locker: l.Locker, address: l.Address})
+	}
+
+	return locks, nil
+}
+
+//-----------------------------------------------------------------------------
+// parseWatchers returns the addresses watching the image.
+//-----------------------------------------------------------------------------
+
+func parseWatchers(out []byte) ([]string, error) {
+
+	var j rbdStatusJSON
+	if err := json.Unmarshal(out, &j); err != nil {
+		return nil, errors.New("Unable to parse the image status: " + err.Error())
+	}
+
+	entries := []rbdWatcherJSON{}
+	err := decodeList(j.Watchers, &entries, func(key string, raw json.RawMessage) error {
+		var w rbdWatcherJSON
+		if err := json.Unmarshal(raw, &w); err != nil {
+			return err
+		}
+		entries = append(entries, w)
+		return nil
+	})
+
+	if err != nil {
+		return nil, errors.New("Unable to parse the image watchers: " + err.Error())
+	}
+
+	watchers := []string{}
+	for _, w := range entries {
+		watchers = append(watchers, w.Address)
+	}
+
+	return watchers, nil
+}
+
+//-----------------------------------------------------------------------------
+// parseMapped returns the mapped images indexed by device.
+//-----------------------------------------------------------------------------
+
+func parseMapped(out []byte) (map[string]mapping, error) {
+
+	entries := []rbdMappedJSON{}
+	err := decodeList(out, &entries, func(key string, raw json.RawMessage) error {
+		var m rbdMappedJSON
+		if err := json.Unmarshal(raw, &m); err != nil {
+			return err
+		}
+		entries = append(entries, m)
+		return nil
+	})
+
+	if err != nil {
+		return nil, errors.New("Unable to parse the mapped images: " + err.Error())
+	}
+
+	mapped := map[string]mapping{}
+	for _, m := range entries {
+		name := m.Name
+		if name == "" {
+			name = m.Image
+		}
+		mapped[m.Device] = mapping{
+			pool:   m.Pool,
+			name:   name,
+			device: m.Device,
+		}
+	}
+
+	return mapped, nil
+}
+
+//-----------------------------------------------------------------------------
+// parseUsage returns the bytes used by the image head, without snapshots.
+//-----------------------------------------------------------------------------
+
+func parseUsage(out []byte, name string) (uint64, error) {
+
+	var j rbdDuJSON
+	if err := json.Unmarshal(out, &j); err != nil {
+		return 0, errors.New("Unable to parse the image usage: " + err.Error())
+	}
+
+	for _, img := range j.Images {
+		if img.Name == name && img.Snapshot == "" {
+			return img.Used, nil
+		}
+	}
+
+	return 0, errors.New("Unable to find the image usage: " + name)
+}
+
+//-----------------------------------------------------------------------------
+// parseSnapshots
+//-----------------------------------------------------------------------------
+
+func parseSnapshots(out []byte) ([]string, error) {
+
+	snaps := []rbdSnapJSON{}
+	if len(bytes.TrimSpace(out)) > 0 {
+		if err := json.Unmarshal(out, &snaps); err != nil {
+			return nil, errors.New("Unable to parse the image snapshots: " + err.Error())
+		}
+	}
+
+	names := []string{}
+	for _, s := range snaps {
+		names = append(names, s.Name)
+	}
+
+	return names, nil
+}
@@ -0,0 +1,187 @@
+//-----------------------------------------------------------------------------
+// Package membership:
+//-----------------------------------------------------------------------------
+
+package main
+
+//-----------------------------------------------------------------------------
+// Imports:
+//-----------------------------------------------------------------------------
+
+import (
+
+	// Standard library:
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+//-----------------------------------------------------------------------------
+// Package variable declarations factored into a block:
+//-----------------------------------------------------------------------------
+
+// Ceph releases with golden --format json output in testdata. Every release
+// describes the same image rbd/data, so the parsed results must match.
+// Luminous prints objects where later releases print arrays.
+var releases = []string{"luminous", "nautilus", "pacific", "quincy"}
+
+//-----------------------------------------------------------------------------
+// golden returns a golden file of a release, or nil if that release lacks
+// the command.
+//-----------------------------------------------------------------------------
+
+func golden(t *testing.T, release, file string) []byte {
+
+	out, err := ioutil.ReadFile(filepath.Join("testdata", release, file+".json"))
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		t.Fatal(err)
+	}
+
+	return out
+}
+
+//-----------------------------------------------------------------------------
+// TestParseGolden
+//-----------------------------------------------------------------------------
+
+func TestParseGolden(t *testing.T) {
+
+	for _, release := range releases {
+		t.Run(release, func(t *testing.T) {
+
+			images, err := parseImages(golden(t, release, "ls"))
+			if want := []string{"data", "logs"}; err != nil || !reflect.DeepEqual(images, want) {
+				t.Errorf("parseImages returned %v (%v), want %v", images, err, want)
+			}
+
+			info, err := parseInfo(golden(t, release, "info"))
+			want := &imageInfo{size: 2147483648, features: []string{"layering", "exclusive-lock", "object-map", "fast-diff", "deep-flatten"}}
+			if err != nil || !reflect.DeepEqual(info, want) {
+				t.Errorf("parseInfo returned %+v (%v), want %+v", info, err, want)
+			}
+
+			locks, err := parseLocks(golden(t, release, "lock-list"))
+			wantLocks := []lockHolder{{id: "dockerLock:node2:9f8e7d6c:abcdef012345", locker: "client.4235", address: "10.0.0.2:0/3512345678"}}
+			if err != nil || !reflect.DeepEqual(locks, wantLocks) {
+				t.Errorf("parseLocks returned %+v (%v), want %+v", locks, err, wantLocks)
+			}
+
+			if locks, err = parseLocks(golden(t, release, "lock-list-empty")); err != nil || len(locks) != 0 {
+				t.Errorf("parseLocks of no locks returned %+v (%v)", locks, err)
+			}
+
+			watchers, err := parseWatchers(golden(t, release, "status"))
+			if want := []string{"10.0.0.2:0/2371386549"}; err != nil || !reflect.DeepEqual(watchers, want) {
+				t.Errorf("parseWatchers returned %v (%v), want %v", watchers, err, want)
+			}
+
+			// Luminous repeats the watcher key
+			watchers, err = parseWatchers(golden(t, release, "status-two"))
+			if want := []string{"10.0.0.2:0/2371386549", "10.0.0.3:0/1184003315"}; err != nil || !reflect.DeepEqual(watchers, want) {
+				t.Errorf("parseWatchers of two watchers returned %v (%v), want %v", watchers, err, want)
+			}
+
+			if watchers, err = parseWatchers(golden(t, release, "status-empty")); err != nil || len(watchers) != 0 {
+				t.Errorf("parseWatchers of no watchers returned %v (%v)", watchers, err)
+			}
+
+			mapped, err := parseMapped(golden(t, release, "showmapped"))
+			wantMapped := map[string]mapping{"/dev/rbd0": {pool: "rbd", name: "data", device: "/dev/rbd0"}}
+			if err != nil || !reflect.DeepEqual(mapped, wantMapped) {
+				t.Errorf("parseMapped returned %+v (%v), want %+v", mapped, err, wantMapped)
+			}
+
+			// rbd-nbd names the image field image
+			if out := golden(t, release, "nbd-list-mapped"); out != nil {
+				mapped, err = parseMapped(out)
+				wantMapped = map[string]mapping{"/dev/nbd0": {pool: "rbd", name: "logs", device: "/dev/nbd0"}}
+				if err != nil || !reflect.DeepEqual(mapped, wantMapped) {
+					t.Errorf("parseMapped of rbd-nbd returned %+v (%v), want %+v", mapped, err, wantMapped)
+				}
+			}
+
+			// The head, not the snapshots listed before it
+			used, err := parseUsage(golden(t, release, "du"), "data")
+			if err != nil || used != 314572800 {
+				t.Errorf("parseUsage returned %d (%v), want 314572800", used, err)
+			}
+
+			if _, err = parseUsage(golden(t, release, "du"), "logs"); err == nil {
+				t.Error("parseUsage found an image not in the output")
+			}
+
+			snaps, err := parseSnapshots(golden(t, release, "snap-ls"))
+			if want := []string{"daily", "weekly"}; err != nil || !reflect.DeepEqual(snaps, want) {
+				t.Errorf("parseSnapshots returned %v (%v), want %v", snaps, err, want)
+			}
+		})
+	}
+}
+
+//-----------------------------------------------------------------------------
+// TestParseEmpty checks the commands that print nothing when there is
+// nothing to list.
+//-----------------------------------------------------------------------------
+
+func TestParseEmpty(t *testing.T) {
+
+	for _, out := range []string{"", "\n"} {
+
+		if images, err := parseImages([]byte(out)); err != nil || len(images) != 0 {
+			t.Errorf("parseImages(%q) returned %v (%v)", out, images, err)
+		}
+
+		if locks, err := parseLocks([]byte(out)); err != nil || len(locks) != 0 {
+			t.Errorf("parseLocks(%q) returned %v (%v)", out, locks, err)
+		}
+
+		if mapped, err := parseMapped([]byte(out)); err != nil || len(mapped) != 0 {
+			t.Errorf("parseMapped(%q) returned %v (%v)", out, mapped, err)
+		}
+
+		if snaps, err := parseSnapshots([]byte(out)); err != nil || len(snaps) != 0 {
+			t.Errorf("parseSnapshots(%q) returned %v (%v)", out, snaps, err)
+		}
+	}
+}
+
+//-----------------------------------------------------------------------------
+// TestParseInvalid
+//-----------------------------------------------------------------------------
+
+func TestParseInvalid(t *testing.T) {
+
+	out := []byte("rbd: error opening image data: (2) No such file or directory")
+
+	if _, err := parseImages(out); err == nil {
+		t.Error("parseImages accepted plain text")
+	}
+
+	if _, err := parseInfo(out); err == nil {
+		t.Error("parseInfo accepted plain text")
+	}
+
+	if _, err := parseLocks(out); err == nil {
+		t.Error("parseLocks accepted plain text")
+	}
+
+	if _, err := parseWatchers(out); err == nil {
+		t.Error("parseWatchers accepted plain text")
+	}
+
+	if _, err := parseMapped(out); err == nil {
+		t.Error("parseMapped accepted plain text")
+	}
+
+	if _, err := parseUsage(out, "data"); err == nil {
+		t.Error("parseUsage accepted plain text")
+	}
+
+	if _, err := parseSnapshots(out); err == nil {
+		t.Error("parseSnapshots accepted plain text")
+	}
+}
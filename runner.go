@@ -0,0 +1,178 @@
+//-----------------------------------------------------------------------------
+// Package membership:
+//-----------------------------------------------------------------------------
+
+package main
+
+//-----------------------------------------------------------------------------
+// Imports:
+//-----------------------------------------------------------------------------
+
+import (
+
+	// Standard library:
+	"bytes"
+	"errors"
+	"os/exec"
+	"strings"
+	"syscall"
+	"time"
+)
+
+//-----------------------------------------------------------------------------
+// Package constant declarations factored into a block:
+//-----------------------------------------------------------------------------
+
+const (
+	// How long to wait for the output of a finished or killed command. A
+	// child in its own session, such as a forked rbd-nbd, may never close it.
+	outputWait = 2 * time.Second
+)
+
+//-----------------------------------------------------------------------------
+// Package variable declarations factored into a block:
+//-----------------------------------------------------------------------------
+
+// Operations with their own deadline.
+var operations = []string{
+	"create", "feature", "fence", "info", "list", "lock", "map", "meta", "mkfs",
+	"mount", "probe", "remove", "rename", "snap", "umount", "unlock", "unmap",
+}
+
+//-----------------------------------------------------------------------------
+// Structs definitions:
+//-----------------------------------------------------------------------------
+
+// runner executes external commands bounded by per-operation deadlines.
+type runner struct {
+	timeout  time.Duration
+	timeouts map[string]time.Duration
+}
+
+//-----------------------------------------------------------------------------
+// newRunner parses the per-operation overrides, as in map=2m,mkfs=10m
+//-----------------------------------------------------------------------------
+
+func newRunner(timeout time.Duration, overrides string) (*runner, error) {
+
+	r := &runner{
+		timeout:  timeout,
+		timeouts: map[string]time.Duration{},
+	}
+
+	known := map[string]bool{}
+	for _, op := range operations {
+		known[op] = true
+	}
+
+	for _, item := range strings.Split(overrides, ",") {
+
+		if item = strings.TrimSpace(item); item == "" {
+			continue
+		}
+
+		kv := strings.SplitN(item, "=", 2)
+		if len(kv) != 2 || !known[kv[0]] {
+			return nil, errors.New("Invalid timeout " + item + ", operations are: " + strings.Join(operations, ", "))
+		}
+
+		d, err := time.ParseDuration(kv[1])
+		if err != nil || d <= 0 {
+			return nil, errors.New("Invalid timeout " + item)
+		}
+
+		r.timeouts[kv[0]] = d
+	}
+
+	return r, nil
+}
+
+//-----------------------------------------------------------------------------
+// deadline
+//-----------------------------------------------------------------------------
+
+func (r *runner) deadline(op string) time.Duration {
+	if d, found := r.timeouts[op]; found {
+		return d
+	}
+	return r.timeout
+}
+
+//-----------------------------------------------------------------------------
+// run executes the command and returns its stdout. On failure the error is a
+// *cmdError built from the exit status and stderr. On timeout the whole
+// process group is killed and the error kind is errTimeout.
+//-----------------------------------------------------------------------------
+
+func (r *runner) run(op, msg string, cmd *exec.Cmd) ([]byte, error) {
+
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	// Own process group so children die with it
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	cmd.WaitDelay = outputWait
+
+	if err := cmd.Start(); err != nil {
+		return nil, newCmdError(msg, cmd, err, "")
+	}
+
+	done := make(chan error, 1)
+	go func() { done <- cmd.Wait() }()
+
+	deadline := r.deadline(op)
+	timer := time.NewTimer(deadline)
+	defer timer.Stop()
+
+	select {
+
+	case err := <-done:
+		if err != nil && err != exec.ErrWaitDelay {
+			return stdout.Bytes(), newCmdError(msg, cmd, err, stderr.String())
+		}
+		return stdout.Bytes(), nil
+
+	case <-timer.C:
+		syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+		<-done
+		e := newCmdError(msg, cmd, errors.New("killed"), stderr.String())
+		e.kind = errTimeout
+		e.stderr = strings.TrimSpace(op + " did not finish in " + deadline.String() + ". " + e.stderr)
+		return stdout.Bytes(), e
+	}
+}
+
+//-----------------------------------------------------------------------------
+// call bounds a function that cannot be killed, such as a write to sysfs. On
+// timeout it returns while the function finishes in the background, then
+// late, if not nil, gets its result to clean up after it.
+//-----------------------------------------------------------------------------
+
+func (r *runner) call(op, msg string, f func() error, late func(error)) error {
+
+	done := make(chan error, 1)
+	go func() { done <- f() }()
+
+	deadline := r.deadline(op)
+	timer := time.NewTimer(deadline)
+	defer timer.Stop()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			return sysError(msg, err)
+		}
+		return nil
+	case <-timer.C:
+		if late != nil {
+			go func() { late(<-done) }()
+		}
+		return &cmdError{
+			op:     msg,
+			code:   -1,
+			stderr: op + " did not finish in " + deadline.String(),
+			kind:   errTimeout,
+		}
+	}
+}
@@ -0,0 +1,102 @@
+//-----------------------------------------------------------------------------
+// Package membership:
+//-----------------------------------------------------------------------------
+
+package main
+
+//-----------------------------------------------------------------------------
+// Imports:
+//-----------------------------------------------------------------------------
+
+import (
+
+	// Standard library:
+	"os/exec"
+	"syscall"
+	"testing"
+	"time"
+)
+
+//-----------------------------------------------------------------------------
+// TestRun
+//-----------------------------------------------------------------------------
+
+func TestRun(t *testing.T) {
+
+	r, err := newRunner(10*time.Second, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	out, err := r.run("info", "Test", exec.Command("sh", "-c", "echo data"))
+	if err != nil || string(out) != "data\n" {
+		t.Errorf("run returned %q (%v)", out, err)
+	}
+
+	_, err = r.run("info", "Test", exec.Command("sh", "-c", "echo 'rbd: error opening image data: (2) No such file or directory' >&2; exit 2"))
+	if e, ok := err.(*cmdError); !ok || e.kind != errNotFound || e.code != 2 {
+		t.Errorf("run of a failing command returned %#v", err)
+	}
+}
+
+//-----------------------------------------------------------------------------
+// TestRunTimeout checks that a command past its deadline is killed with its
+// whole process group.
+//-----------------------------------------------------------------------------
+
+func TestRunTimeout(t *testing.T) {
+
+	r, err := newRunner(10*time.Second, "map=100ms")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cmd := exec.Command("sh", "-c", "sleep 10 & sleep 10")
+	start := time.Now()
+	_, err = r.run("map", "Test", cmd)
+
+	if errorKind(err) != errTimeout {
+		t.Errorf("run past the deadline returned %v", err)
+	}
+
+	if took := time.Since(start); took > 5*time.Second {
+		t.Errorf("run past the deadline took %s", took)
+	}
+
+	// Orphans are gone once init reaps them
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		if err = syscall.Kill(-cmd.Process.Pid, 0); err == syscall.ESRCH {
+			break
+		} else if time.Now().After(deadline) {
+			t.Fatalf("process group of a killed command: %v", err)
+		}
+	}
+}
+
+//-----------------------------------------------------------------------------
+// TestRunDetached checks that a child in its own session, still holding the
+// output of a killed command, does not keep run waiting.
+//-----------------------------------------------------------------------------
+
+func TestRunDetached(t *testing.T) {
+
+	if _, err := exec.LookPath("setsid"); err != nil {
+		t.Skip("setsid not found")
+	}
+
+	r, err := newRunner(10*time.Second, "map=100ms")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Now()
+	_, err = r.run("map", "Test", exec.Command("sh", "-c", "setsid sleep 30 & sleep 30"))
+
+	if errorKind(err) != errTimeout {
+		t.Errorf("run past the deadline returned %v", err)
+	}
+
+	if took := time.Since(start); took > outputWait+5*time.Second {
+		t.Errorf("run past the deadline took %s", took)
+	}
+}
@@ -0,0 +1,239 @@
+//-----------------------------------------------------------------------------
+// Package membership:
+//-----------------------------------------------------------------------------
+
+package main
+
+//-----------------------------------------------------------------------------
+// Imports:
+//-----------------------------------------------------------------------------
+
+import (
+
+	// Standard library:
+	"errors"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+//-----------------------------------------------------------------------------
+// enter registers an API request unless the driver is shutting down.
+//-----------------------------------------------------------------------------
+
+func (d *rbdDriver) enter() error {
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	if d.closing {
+		return errors.New("Volume plugin is shutting down")
+	}
+
+	d.inflight.Add(1)
+	return nil
+}
+
+//-----------------------------------------------------------------------------
+// leave
+//-----------------------------------------------------------------------------
+
+func (d *rbdDriver) leave() {
+	d.inflight.Done()
+}
+
+//-----------------------------------------------------------------------------
+// releaseVolume unmounts, unmaps and unlocks a mounted volume and forgets it.
+// Steps done by a failed attempt are skipped when retried. The caller must
+// hold the volume lock.
+//-----------------------------------------------------------------------------
+
+func (d *rbdDriver) releaseVolume(tag string, cl *cluster, mountpoint string, vol *volume) error {
+
+	// Unmount the device, unless it is not mounted anymore
+	if !vol.unmounted && d.isMounted(tag, mountpoint, vol.device) {
+		log.Printf("[%s] INFO unmounting device %s", tag, vol.device)
+		if err := d.host.unmountDevice(vol.device); err != nil {
+			log.Printf("[%s] ERROR unmounting device: %s", tag, err)
+			return err
+		}
+	}
+	vol.unmounted = true
+
+	// Unmap the image with the mode used to map it
+	if !vol.unmapped {
+		log.Printf("[%s] INFO unmapping image %s", tag, vol.name)
+		m, err := cl.mapperFor(vol.mapping)
+		if err == nil {
+			err = m.unmapImage(vol.device)
+		}
+
+		if err != nil {
+			log.Printf("[%s] ERROR unmapping image: %s", tag, err)
+			return err
+		}
+	}
+	vol.unmapped = true
+
+	// Release the lease
+	var err error
+	if d.leaseTTL > 0 && vol.lockID != "" {
+		if err = d.releaseLease(cl, vol); err != nil {
+			log.Printf("[%s] WARN unable to release the lease: %s", tag, err)
+		}
+	}
+
+	// Forget the mapping client
+	if vol.lockID != "" {
+		if err = d.forgetClient(cl, vol.pool, vol.name); err != nil {
+			log.Printf("[%s] WARN unable to forget the mapping client: %s", tag, err)
+		}
+	}
+
+	// Unlock the image with the strategy used to lock it
+	log.Printf("[%s] INFO unlocking image %s", tag, vol.name)
+	strategy, err := d.strategyFor(vol.locking)
+	if err == nil {
+		err = strategy.release(cl, vol.pool, vol.name, vol.lockID, vol.locker)
+	}
+
+	if err != nil {
+		log.Printf("[%s] ERROR unlocking image: %s", tag, err)
+		return err
+	}
+
+	// Forget the volume
+	d.delVolume(mountpoint)
+	return nil
+}
+
+//-----------------------------------------------------------------------------
+// isMounted tells whether the device is mounted on the mountpoint, assuming
+// it is if the mount table cannot be read.
+//-----------------------------------------------------------------------------
+
+func (d *rbdDriver) isMounted(tag, mountpoint, device string) bool {
+
+	mounts, err := d.host.listMounts(d.volRoot)
+	if err != nil {
+		return true
+	}
+
+	if mounts[mountpoint] != device {
+		log.Printf("[%s] WARN %s is not mounted on %s, skipping umount", tag, device, mountpoint)
+		return false
+	}
+
+	return true
+}
+
+//-----------------------------------------------------------------------------
+// shutdown refuses new requests, waits for the ones in flight and, if asked
+// to, releases every mounted volume even if containers still use it. It gives
+// up after the timeout and logs what was done.
+//-----------------------------------------------------------------------------
+
+func (d *rbdDriver) shutdown(timeout time.Duration, release bool) {
+
+	// Refuse new requests
+	d.mutex.Lock()
+	d.closing = true
+	d.mutex.Unlock()
+
+	deadline := time.After(timeout)
+	released, failed := []string{}, []string{}
+	var summary sync.Mutex
+
+	// Drain the requests in flight
+	log.Printf("[Shutdown] INFO waiting for requests in flight...")
+	drained := make(chan struct{})
+	go func() { d.inflight.Wait(); close(drained) }()
+
+	select {
+	case <-drained:
+	case <-deadline:
+		log.Printf("[Shutdown] ERROR requests still in flight after %s", timeout)
+		d.logShutdown(released, failed)
+		return
+	}
+
+	// Release the volumes
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if !release {
+			return
+		}
+		for _, mountpoint := range d.mountpoints() {
+			vol, found := d.getVolume(mountpoint)
+			if !found {
+				continue
+			}
+			name := vol.cluster + "/" + vol.pool + "/" + vol.name
+			cl := d.clusters[vol.cluster]
+			unlock := d.lockVolume(cl, vol.pool, vol.name)
+			err := d.releaseVolume("Shutdown", cl, mountpoint, vol)
+			unlock()
+			summary.Lock()
+			if err != nil {
+				failed = append(failed, name+" ("+err.Error()+")")
+			} else {
+				released = append(released, name)
+			}
+			summary.Unlock()
+		}
+	}()
+
+	select {
+	case <-done:
+	case <-deadline:
+		log.Printf("[Shutdown] ERROR releasing volumes took longer than %s", timeout)
+	}
+
+	summary.Lock()
+	defer summary.Unlock()
+	d.logShutdown(released, failed)
+}
+
+//-----------------------------------------------------------------------------
+// mountpoints returns the mountpoints of the mounted volumes, sorted.
+//-----------------------------------------------------------------------------
+
+func (d *rbdDriver) mountpoints() []string {
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	mountpoints := []string{}
+	for mountpoint := range d.volumes {
+		mountpoints = append(mountpoints, mountpoint)
+	}
+	sort.Strings(mountpoints)
+
+	return mountpoints
+}
+
+//-----------------------------------------------------------------------------
+// logShutdown summarizes the released volumes and the ones left behind.
+//-----------------------------------------------------------------------------
+
+func (d *rbdDriver) logShutdown(released, failed []string) {
+
+	left := []string{}
+	d.mutex.Lock()
+	for _, vol := range d.volumes {
+		left = append(left, vol.cluster+"/"+vol.pool+"/"+vol.name)
+	}
+	d.mutex.Unlock()
+	sort.Strings(left)
+
+	log.Printf("[Shutdown] INFO released %d volumes: %s", len(released), strings.Join(released, ", "))
+	if len(failed) > 0 {
+		log.Printf("[Shutdown] ERROR failed to release %d volumes: %s", len(failed), strings.Join(failed, ", "))
+	}
+	if len(left) > 0 {
+		log.Printf("[Shutdown] WARN %d volumes remain mounted and locked: %s", len(left), strings.Join(left, ", "))
+	}
+}
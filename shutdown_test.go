@@ -0,0 +1,216 @@
+//-----------------------------------------------------------------------------
+// Package membership:
+//-----------------------------------------------------------------------------
+
+package main
+
+//-----------------------------------------------------------------------------
+// Imports:
+//-----------------------------------------------------------------------------
+
+import (
+
+	// Standard library:
+	"testing"
+	"time"
+
+	// Community:
+	dkvolume "github.com/docker/go-plugins-helpers/volume"
+)
+
+//-----------------------------------------------------------------------------
+// TestReleaseRetry checks that an Unmount failing after the umount can be
+// retried, and that a mountpoint unmounted by hand is not unmounted again.
+//-----------------------------------------------------------------------------
+
+func TestReleaseRetry(t *testing.T) {
+
+	for _, op := range []string{"unmap", "unlock"} {
+
+		d, f := newTestDriver(t)
+		f.addImage("rbd", "data", "xfs")
+
+		if r := d.Mount(dkvolume.MountRequest{Name: "data", ID: "c1"}); r.Err != "" {
+			t.Fatalf("Mount: %s", r.Err)
+		}
+
+		f.fail(op)
+		if r := d.Unmount(dkvolume.UnmountRequest{Name: "data", ID: "c1"}); r.Err == "" {
+			t.Errorf("Unmount with a failed %s succeeded", op)
+		}
+
+		f.heal(op)
+		umounts := f.calls["umount"]
+		if r := d.Unmount(dkvolume.UnmountRequest{Name: "data", ID: "c1"}); r.Err != "" {
+			t.Errorf("Unmount after a failed %s: %s", op, r.Err)
+		}
+
+		if f.calls["umount"] != umounts {
+			t.Errorf("Unmount after a failed %s unmounted again", op)
+		}
+
+		if left := f.leaks(); len(left) > 0 || len(d.volumes) != 0 {
+			t.Errorf("Unmount after a failed %s left %v and %d volumes", op, left, len(d.volumes))
+		}
+	}
+
+	// Unmounted by hand
+	d, f := newTestDriver(t)
+	f.addImage("rbd", "data", "xfs")
+
+	r := d.Mount(dkvolume.MountRequest{Name: "data", ID: "c1"})
+	if r.Err != "" {
+		t.Fatalf("Mount: %s", r.Err)
+	}
+	delete(f.mounts, r.Mountpoint)
+
+	if r := d.Unmount(dkvolume.UnmountRequest{Name: "data", ID: "c1"}); r.Err != "" {
+		t.Errorf("Unmount of a volume unmounted by hand: %s", r.Err)
+	}
+
+	if left := f.leaks(); len(left) > 0 || f.calls["umount"] != 0 {
+		t.Errorf("Unmount of a volume unmounted by hand left %v after %d umounts", left, f.calls["umount"])
+	}
+}
+
+//-----------------------------------------------------------------------------
+// TestShutdown
+//-----------------------------------------------------------------------------
+
+func TestShutdown(t *testing.T) {
+
+	for _, release := range []bool{true, false} {
+
+		d, f := newTestDriver(t)
+		f.addImage("rbd", "data", "xfs")
+		f.addImage("rbd", "logs", "xfs")
+
+		for _, name := range []string{"data", "logs"} {
+			if r := d.Mount(dkvolume.MountRequest{Name: name, ID: "c1"}); r.Err != "" {
+				t.Fatalf("Mount: %s", r.Err)
+			}
+		}
+
+		d.shutdown(5*time.Second, release)
+
+		if release {
+			if left := f.leaks(); len(left) > 0 || len(d.volumes) != 0 {
+				t.Errorf("shutdown with release left %v and %d volumes", left, len(d.volumes))
+			}
+		} else if len(f.mounts) != 2 || len(d.volumes) != 2 {
+			t.Errorf("shutdown without release left %d mounts and %d volumes", len(f.mounts), len(d.volumes))
+		}
+
+		// No new requests
+		if r := d.Get(dkvolume.Request{Name: "data"}); r.Err == "" {
+			t.Error("Get succeeded after shutdown")
+		}
+	}
+}
+
+//-----------------------------------------------------------------------------
+// TestShutdownDrain checks that shutdown waits for a Mount in flight and
+// releases what it mounted.
+//-----------------------------------------------------------------------------
+
+func TestShutdownDrain(t *testing.T) {
+
+	d, f := newTestDriver(t)
+	d.lockWait = time.Second
+	img := f.addImage("rbd", "data", "xfs")
+	f.addLock("rbd", "data", staleID)
+
+	mounted := make(chan dkvolume.Response, 1)
+	go func() { mounted <- d.Mount(dkvolume.MountRequest{Name: "data", ID: "c1"}) }()
+
+	// Mount is waiting for the lock
+	for tried := false; !tried; {
+		time.Sleep(time.Millisecond)
+		f.mutex.Lock()
+		tried = f.calls["lock"] > 0
+		f.mutex.Unlock()
+	}
+
+	done := make(chan struct{})
+	go func() {
+		d.shutdown(5*time.Second, true)
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		t.Fatal("shutdown did not wait for Mount")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	// The holder lets go before the next attempt
+	f.mutex.Lock()
+	img.locks = nil
+	f.mutex.Unlock()
+
+	if r := <-mounted; r.Err != "" {
+		t.Fatalf("Mount: %s", r.Err)
+	}
+
+	// What Mount did is released
+	<-done
+	if left := f.leaks(); len(left) > 0 || len(d.volumes) != 0 {
+		t.Errorf("shutdown left %v and %d volumes", left, len(d.volumes))
+	}
+}
+
+//-----------------------------------------------------------------------------
+// TestShutdownTimeout checks that shutdown gives up on requests that do not
+// finish and on releases that hang.
+//-----------------------------------------------------------------------------
+
+func TestShutdownTimeout(t *testing.T) {
+
+	// A request that never finishes
+	d, f := newTestDriver(t)
+	f.addImage("rbd", "data", "xfs")
+
+	if r := d.Mount(dkvolume.MountRequest{Name: "data", ID: "c1"}); r.Err != "" {
+		t.Fatalf("Mount: %s", r.Err)
+	}
+
+	if err := d.enter(); err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Now()
+	d.shutdown(50*time.Millisecond, true)
+
+	if took := time.Since(start); took > time.Second {
+		t.Errorf("shutdown with a request in flight took %s", took)
+	}
+
+	if len(f.mounts) != 1 || len(d.volumes) != 1 {
+		t.Errorf("shutdown with a request in flight left %d mounts and %d volumes", len(f.mounts), len(d.volumes))
+	}
+	d.leave()
+
+	// A umount that hangs
+	d, f = newTestDriver(t)
+	f.addImage("rbd", "data", "xfs")
+
+	if r := d.Mount(dkvolume.MountRequest{Name: "data", ID: "c1"}); r.Err != "" {
+		t.Fatalf("Mount: %s", r.Err)
+	}
+
+	hung := make(chan struct{})
+	f.hook("umount", func(n int) { <-hung })
+
+	start = time.Now()
+	d.shutdown(50*time.Millisecond, true)
+
+	if took := time.Since(start); took > time.Second {
+		t.Errorf("shutdown with a hanging umount took %s", took)
+	}
+
+	// The release goes on in the background
+	close(hung)
+	for len(d.mountpoints()) > 0 {
+		time.Sleep(time.Millisecond)
+	}
+}
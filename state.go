@@ -0,0 +1,400 @@
+//-----------------------------------------------------------------------------
+// Package membership:
+//-----------------------------------------------------------------------------
+
+package main
+
+//-----------------------------------------------------------------------------
+// Imports:
+//-----------------------------------------------------------------------------
+
+import (
+
+	// Standard library:
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+//-----------------------------------------------------------------------------
+// Package constant declarations:
+//-----------------------------------------------------------------------------
+
+const stateFile = ".state.json"
+
+//-----------------------------------------------------------------------------
+// Structs definitions:
+//-----------------------------------------------------------------------------
+
+type volumeState struct {
+	Mountpoint string   `json:"mountpoint"`
+	Cluster    string   `json:"cluster"`
+	Pool       string   `json:"pool"`
+	Name       string   `json:"name"`
+	Device     string   `json:"device"`
+	LockID     string   `json:"lockID"`
+	Locker     string   `json:"locker"`
+	FsType     string   `json:"fstype"`
+	Mapping    string   `json:"mapping"`
+	Locking    string   `json:"locking"`
+	IDs        []string `json:"ids"`
+}
+
+// volumeLock is a volume mutex with the number of operations holding or
+// waiting for it.
+type volumeLock struct {
+	mutex sync.Mutex
+	refs  int
+}
+
+//-----------------------------------------------------------------------------
+// lockVolume serializes the operations on a given cluster/pool/image.
+// Operations on different images proceed in parallel. It returns the unlock
+// function. The mutex is dropped once no operation uses it.
+//-----------------------------------------------------------------------------
+
+func (d *rbdDriver) lockVolume(cl *cluster, pool, name string) func() {
+
+	key := cl.name + "/" + pool + "/" + name
+
+	// Get or create the volume mutex
+	d.mutex.Lock()
+	l, found := d.locks[key]
+	if !found {
+		l = &volumeLock{}
+		d.locks[key] = l
+	}
+	l.refs++
+	d.mutex.Unlock()
+
+	l.mutex.Lock()
+	return func() {
+		l.mutex.Unlock()
+		d.mutex.Lock()
+		if l.refs--; l.refs == 0 {
+			delete(d.locks, key)
+		}
+		d.mutex.Unlock()
+	}
+}
+
+//-----------------------------------------------------------------------------
+// getVolume
+//-----------------------------------------------------------------------------
+
+func (d *rbdDriver) getVolume(mountpoint string) (*volume, bool) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	vol, found := d.volumes[mountpoint]
+	return vol, found
+}
+
+//-----------------------------------------------------------------------------
+// putVolume
+//-----------------------------------------------------------------------------
+
+func (d *rbdDriver) putVolume(mountpoint string, vol *volume) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.volumes[mountpoint] = vol
+	d.saveState()
+}
+
+//-----------------------------------------------------------------------------
+// delVolume
+//-----------------------------------------------------------------------------
+
+func (d *rbdDriver) delVolume(mountpoint string) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	delete(d.volumes, mountpoint)
+	d.saveState()
+}
+
+//-----------------------------------------------------------------------------
+// volumeStatus returns the local state of a mounted volume. Callers without
+// the volume lock must read it here.
+//-----------------------------------------------------------------------------
+
+func (d *rbdDriver) volumeStatus(vol *volume) map[string]interface{} {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	return map[string]interface{}{
+		"fstype":  vol.fstype,
+		"device":  vol.device,
+		"mapping": vol.mapping,
+		"locking": vol.locking,
+		"mounted": true,
+		"mounts":  len(vol.ids),
+	}
+}
+
+//-----------------------------------------------------------------------------
+// addMountID registers a caller of the volume. It returns false if the caller
+// was already known.
+//-----------------------------------------------------------------------------
+
+func (d *rbdDriver) addMountID(vol *volume, id string) bool {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	defer d.saveState()
+
+	if _, found := vol.ids[id]; found {
+		return false
+	}
+
+	vol.ids[id] = struct{}{}
+	return true
+}
+
+//-----------------------------------------------------------------------------
+// delMountID forgets a caller of the volume. It returns the number of callers
+// left and whether the caller was known. Volumes adopted without callers
+// accept any caller.
+//-----------------------------------------------------------------------------
+
+func (d *rbdDriver) delMountID(vol *volume, id string) (int, bool) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	defer d.saveState()
+
+	if _, found := vol.ids[id]; !found && len(vol.ids) > 0 {
+		return len(vol.ids), false
+	}
+
+	delete(vol.ids, id)
+	return len(vol.ids), true
+}
+
+//-----------------------------------------------------------------------------
+// saveState writes the volume table to the state file. The caller must hold
+// the driver mutex.
+//-----------------------------------------------------------------------------
+
+func (d *rbdDriver) saveState() {
+
+	// Serialize the volume table
+	states := []volumeState{}
+	for mountpoint, vol := range d.volumes {
+		st := volumeState{
+			Mountpoint: mountpoint,
+			Cluster:    vol.cluster,
+			Pool:       vol.pool,
+			Name:       vol.name,
+			Device:     vol.device,
+			LockID:     vol.lockID,
+			Locker:     vol.locker,
+			FsType:     vol.fstype,
+			Mapping:    vol.mapping,
+			Locking:    vol.locking,
+			IDs:        []string{},
+		}
+		for id := range vol.ids {
+			st.IDs = append(st.IDs, id)
+		}
+		states = append(states, st)
+	}
+
+	data, err := json.MarshalIndent(states, "", "  ")
+	if err != nil {
+		log.Printf("[State] ERROR encoding state: %s", err)
+		return
+	}
+
+	// Write and rename to never leave a truncated file
+	if err = os.MkdirAll(d.volRoot, os.ModeDir|os.FileMode(int(0775))); err != nil {
+		log.Printf("[State] ERROR creating %s: %s", d.volRoot, err)
+		return
+	}
+
+	file := filepath.Join(d.volRoot, stateFile)
+	if err = ioutil.WriteFile(file+".tmp", data, 0600); err != nil {
+		log.Printf("[State] ERROR writing state: %s", err)
+		return
+	}
+
+	if err = os.Rename(file+".tmp", file); err != nil {
+		log.Printf("[State] ERROR writing state: %s", err)
+	}
+}
+
+//-----------------------------------------------------------------------------
+// loadState reads the state file indexed by mountpoint.
+//-----------------------------------------------------------------------------
+
+func (d *rbdDriver) loadState() (map[string]volumeState, error) {
+
+	saved := map[string]volumeState{}
+
+	// A missing file is a clean start
+	data, err := ioutil.ReadFile(filepath.Join(d.volRoot, stateFile))
+	if os.IsNotExist(err) {
+		return saved, nil
+	} else if err != nil {
+		return saved, err
+	}
+
+	states := []volumeState{}
+	if err = json.Unmarshal(data, &states); err != nil {
+		return saved, err
+	}
+
+	for _, st := range states {
+		saved[st.Mountpoint] = st
+	}
+
+	return saved, nil
+}
+
+//-----------------------------------------------------------------------------
+// recover rebuilds the volume table from the mapped images, the mount table
+// and the image locks, using the state file to restore the mount callers.
+// Consistent entries are adopted and inconsistent ones are reported.
+//-----------------------------------------------------------------------------
+
+func (d *rbdDriver) recover() {
+
+	// Previous state, if any
+	saved, err := d.loadState()
+	if err != nil {
+		log.Printf("[Init] WARN unable to load state: %s", err)
+	}
+
+	// What is mounted below the volume root
+	mounts, err := d.host.listMounts(d.volRoot)
+	if err != nil {
+		log.Printf("[Init] ERROR recovering state: %s", err)
+		return
+	}
+
+	// What is mapped on this host, in every mode
+	mapped := map[string]mapping{}
+	for mode, m := range d.clusters[d.defCluster].mappers {
+		devices, err := m.showMapped()
+		if err != nil {
+			log.Printf("[Init] ERROR recovering state: %s", err)
+			return
+		}
+		for device, mp := range devices {
+			mp.mode = mode
+			mapped[device] = mp
+		}
+	}
+
+	adopted := map[string]bool{}
+
+	for mountpoint, device := range mounts {
+
+		// Expect volRoot/cluster/pool/name, or volRoot/pool/name in the
+		// default cluster from versions without cluster profiles
+		rel, _ := filepath.Rel(d.volRoot, mountpoint)
+		parts := strings.Split(rel, "/")
+		if len(parts) == 2 {
+			parts = append([]string{d.defCluster}, parts...)
+		}
+
+		if len(parts) != 3 {
+			log.Printf("[Init] WARN unexpected mount %s", mountpoint)
+			continue
+		}
+
+		cl, found := d.clusters[parts[0]]
+		if !found {
+			log.Printf("[Init] WARN %s belongs to unknown cluster %s", mountpoint, parts[0])
+			continue
+		}
+		pool, name := parts[1], parts[2]
+
+		// The device must be the image mapping
+		m, found := mapped[device]
+		if !found || m.pool != pool || m.name != name {
+			log.Printf("[Init] WARN %s is mounted on %s but it is not %s/%s", device, mountpoint, pool, name)
+			continue
+		}
+
+		// Find out the lock owner
+		locks, err := d.imageLocks(cl, pool, name)
+		if err != nil {
+			log.Printf("[Init] WARN unable to list locks of %s/%s: %s", pool, name, err)
+		}
+
+		st, found := saved[mountpoint]
+		if found && st.Device != device {
+			st, found = volumeState{}, false
+		}
+
+		// Only locks of this host, or a bare lock of an older version
+		// this host saved, are ours
+		var lock lockHolder
+		for _, l := range locks {
+			switch {
+			case l.host() == d.hostname && (l.id == st.LockID || len(locks) == 1):
+				lock = l
+			case l.id == lockPrefix && found && l.locker == st.Locker:
+				lock = l
+			default:
+				log.Printf("[Init] WARN %s/%s is mounted here but locked by %s, leaving it alone", pool, name, l)
+			}
+		}
+
+		// States saved before the locking strategies were advisory
+		locking := st.Locking
+		if locking == "" && found {
+			locking = lockingAdvisory
+		} else if locking == "" {
+			locking = d.imageLocking(cl, pool, name)
+		}
+
+		if lock.locker == "" && locking == lockingAdvisory {
+			log.Printf("[Init] WARN %s/%s is mounted but its lock is unknown", pool, name)
+		}
+
+		// The file system in use
+		fstype, _, err := d.host.probeDevice(device)
+		if err != nil {
+			fstype = st.FsType
+		}
+
+		ids := map[string]struct{}{}
+		for _, id := range st.IDs {
+			ids[id] = struct{}{}
+		}
+
+		log.Printf("[Init] INFO adopting %s/%s on %s", pool, name, mountpoint)
+		d.volumes[mountpoint] = &volume{
+			name:    name,
+			device:  device,
+			lockID:  lock.id,
+			locker:  lock.locker,
+			fstype:  fstype,
+			pool:    pool,
+			cluster: cl.name,
+			mapping: m.mode,
+			locking: locking,
+			ids:     ids,
+		}
+		adopted[device] = true
+	}
+
+	// Report what could not be adopted
+	for mountpoint, st := range saved {
+		if _, found := d.volumes[mountpoint]; !found {
+			log.Printf("[Init] WARN %s/%s/%s was mounted on %s but it is not anymore", st.Cluster, st.Pool, st.Name, mountpoint)
+		}
+	}
+
+	// Mappings do not tell the cluster
+	for device, m := range mapped {
+		if !adopted[device] {
+			log.Printf("[Init] WARN %s/%s is mapped to %s but it is not mounted", m.pool, m.name, device)
+		}
+	}
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.saveState()
+}
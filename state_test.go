@@ -0,0 +1,249 @@
+//-----------------------------------------------------------------------------
+// Package membership:
+//-----------------------------------------------------------------------------
+
+package main
+
+//-----------------------------------------------------------------------------
+// Imports:
+//-----------------------------------------------------------------------------
+
+import (
+
+	// Standard library:
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	// Community:
+	dkvolume "github.com/docker/go-plugins-helpers/volume"
+)
+
+//-----------------------------------------------------------------------------
+// TestLockVolume
+//-----------------------------------------------------------------------------
+
+func TestLockVolume(t *testing.T) {
+
+	d, _ := newTestDriver(t)
+	cl := d.clusters["ceph"]
+
+	// Other volumes are not blocked
+	unlock := d.lockVolume(cl, "rbd", "one")
+	d.lockVolume(cl, "rbd", "two")()
+
+	// The same volume is
+	locked := make(chan struct{})
+	go func() {
+		d.lockVolume(cl, "rbd", "one")()
+		close(locked)
+	}()
+
+	select {
+	case <-locked:
+		t.Fatal("lockVolume did not serialize the same volume")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	unlock()
+	<-locked
+
+	if len(d.locks) != 0 {
+		t.Errorf("lockVolume kept %d unused mutexes", len(d.locks))
+	}
+}
+
+//-----------------------------------------------------------------------------
+// TestConcurrentVolumes runs Create, Mount, Get and Unmount from many callers
+// on a few volumes at once. Run it with -race.
+//-----------------------------------------------------------------------------
+
+func TestConcurrentVolumes(t *testing.T) {
+
+	const (
+		volumes    = 4
+		callers    = 8
+		iterations = 25
+	)
+
+	d, f := newTestDriver(t)
+	var wg sync.WaitGroup
+
+	for c := 0; c < callers; c++ {
+		wg.Add(1)
+		go func(c int) {
+			defer wg.Done()
+			for i := 0; i < iterations; i++ {
+
+				name := "vol" + strconv.Itoa((c+i)%volumes)
+				id := "c" + strconv.Itoa(c) + "i" + strconv.Itoa(i)
+
+				if r := d.Create(dkvolume.Request{Name: name}); r.Err != "" {
+					t.Errorf("Create %s: %s", name, r.Err)
+					return
+				}
+
+				if r := d.Mount(dkvolume.MountRequest{Name: name, ID: id}); r.Err != "" {
+					t.Errorf("Mount %s as %s: %s", name, id, r.Err)
+					return
+				}
+
+				if r := d.Get(dkvolume.Request{Name: name}); r.Err != "" || r.Volume.Status["mounted"] != true {
+					t.Errorf("Get %s: %s", name, r.Err)
+				}
+
+				d.List(dkvolume.Request{})
+
+				if r := d.Unmount(dkvolume.UnmountRequest{Name: name, ID: id}); r.Err != "" {
+					t.Errorf("Unmount %s as %s: %s", name, id, r.Err)
+					return
+				}
+			}
+		}(c)
+	}
+
+	wg.Wait()
+
+	if left := f.leaks(); len(left) > 0 {
+		t.Errorf("left %v", left)
+	}
+
+	if len(d.volumes) != 0 {
+		t.Errorf("%d volumes still registered", len(d.volumes))
+	}
+
+	if len(d.locks) != 0 {
+		t.Errorf("%d volume mutexes kept", len(d.locks))
+	}
+}
+
+//-----------------------------------------------------------------------------
+// restart returns a new driver process on the same host, recovered from what
+// the previous one left.
+//-----------------------------------------------------------------------------
+
+func restart(t *testing.T, d *rbdDriver, f *fakeCeph) *rbdDriver {
+
+	r, _ := newTestDriver(t)
+	r.volRoot = d.volRoot
+	r.instance = "1b2c3d4e"
+	r.host = f
+	r.clusters["ceph"] = newCluster("ceph", clusterConfig{}, f, map[string]mapper{mappingKRBD: f})
+
+	r.recover()
+	return r
+}
+
+//-----------------------------------------------------------------------------
+// TestRecover checks that consistent mounts are adopted with their callers.
+//-----------------------------------------------------------------------------
+
+func TestRecover(t *testing.T) {
+
+	d, f := newTestDriver(t)
+	f.addImage("rbd", "data", "xfs")
+	f.addImage("rbd", "old", "ext4")
+
+	for _, id := range []string{"c1", "c2"} {
+		if r := d.Mount(dkvolume.MountRequest{Name: "data", ID: id}); r.Err != "" {
+			t.Fatalf("Mount: %s", r.Err)
+		}
+	}
+	mounted, _ := d.getVolume(d.mountpoint(d.clusters["ceph"], "rbd", "data"))
+
+	// Mounted by a version without cluster profiles
+	device, err := f.mapImage("rbd", "old", mapOpts{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	legacy := filepath.Join(d.volRoot, "rbd", "old")
+	f.mounts[legacy] = device
+	f.addLock("rbd", "old", lockPrefix)
+
+	r := restart(t, d, f)
+
+	vol, found := r.getVolume(filepath.Join(d.volRoot, "ceph", "rbd", "data"))
+	if !found {
+		t.Fatal("recover did not adopt rbd/data")
+	}
+
+	if vol.device != mounted.device || vol.lockID != mounted.lockID || vol.locker != mounted.locker ||
+		vol.mapping != mappingKRBD || vol.locking != lockingAdvisory || vol.fstype != "xfs" {
+		t.Errorf("recover adopted %+v, want %+v", vol, mounted)
+	}
+
+	// The callers come from the state file
+	if want := map[string]struct{}{"c1": {}, "c2": {}}; !reflect.DeepEqual(vol.ids, want) {
+		t.Errorf("recover restored the callers %v, want %v", vol.ids, want)
+	}
+
+	// A bare lock is only ours with a saved state
+	vol, found = r.getVolume(legacy)
+	if !found || vol.cluster != "ceph" || vol.device != device || vol.fstype != "ext4" || vol.lockID != "" || len(vol.ids) != 0 {
+		t.Errorf("recover adopted %+v on %s", vol, legacy)
+	}
+
+	// The adopted volumes unmount as usual
+	for _, c := range []struct{ name, id string }{{"data", "c1"}, {"data", "c2"}, {"old", "c1"}} {
+		if resp := r.Unmount(dkvolume.UnmountRequest{Name: c.name, ID: c.id}); resp.Err != "" {
+			t.Errorf("Unmount of %s by %s: %s", c.name, c.id, resp.Err)
+		}
+	}
+
+	if left := f.leaks(); len(left) != 1 || !strings.Contains(left[0], lockPrefix) {
+		t.Errorf("Unmount of the adopted volumes left %v", left)
+	}
+}
+
+//-----------------------------------------------------------------------------
+// TestRecoverInconsistent checks that a mount of the wrong device is not
+// adopted and that the lock of another host is left alone.
+//-----------------------------------------------------------------------------
+
+func TestRecoverInconsistent(t *testing.T) {
+
+	d, f := newTestDriver(t)
+	f.addImage("rbd", "data", "xfs")
+	f.addImage("rbd", "logs", "xfs")
+	f.addImage("rbd", "shared", "xfs")
+
+	// rbd/data mounted with the device of rbd/logs
+	device, err := f.mapImage("rbd", "logs", mapOpts{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	wrong := filepath.Join(d.volRoot, "ceph", "rbd", "data")
+	f.mounts[wrong] = device
+
+	// rbd/shared mounted here but locked by node2
+	if device, err = f.mapImage("rbd", "shared", mapOpts{}); err != nil {
+		t.Fatal(err)
+	}
+	foreign := filepath.Join(d.volRoot, "ceph", "rbd", "shared")
+	f.mounts[foreign] = device
+	f.addLock("rbd", "shared", staleID)
+
+	r := restart(t, d, f)
+
+	if vol, found := r.getVolume(wrong); found {
+		t.Errorf("recover adopted %+v on the device of another image", vol)
+	}
+
+	vol, found := r.getVolume(foreign)
+	if !found || vol.lockID != "" || vol.locker != "" {
+		t.Fatalf("recover adopted %+v locked by another host", vol)
+	}
+
+	// Unmounting it does not touch the lock
+	if resp := r.Unmount(dkvolume.UnmountRequest{Name: "shared", ID: "c1"}); resp.Err != "" {
+		t.Fatalf("Unmount: %s", resp.Err)
+	}
+
+	if locks, _ := r.imageLocks(r.clusters["ceph"], "rbd", "shared"); len(locks) != 1 || locks[0].id != staleID {
+		t.Errorf("Unmount left the locks %v", locks)
+	}
+}
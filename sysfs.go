@@ -0,0 +1,386 @@
+//-----------------------------------------------------------------------------
+// Package membership:
+//-----------------------------------------------------------------------------
+
+package main
+
+//-----------------------------------------------------------------------------
+// Imports:
+//-----------------------------------------------------------------------------
+
+import (
+
+	// Standard library:
+	"bufio"
+	"errors"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+//-----------------------------------------------------------------------------
+// Package variable declarations factored into a block:
+//-----------------------------------------------------------------------------
+
+var (
+	monV1Regex  = regexp.MustCompile(`v1:([^,\]\s/]+)`)
+	deviceRegex = regexp.MustCompile(`^/dev/rbd([0-9]+)$`)
+)
+
+//-----------------------------------------------------------------------------
+// Structs definitions:
+//-----------------------------------------------------------------------------
+
+// sysfsMapper implements mapper with the kernel RBD sysfs interface so no rbd
+// binary is needed to map and unmap images.
+type sysfsMapper struct {
+	root   string
+	mons   string
+	id     string
+	secret string
+	runner *runner
+
+	// Images whose map request outlived its deadline:
+	mutex   sync.Mutex
+	pending map[string]bool
+}
+
+//-----------------------------------------------------------------------------
+// newSysfsMapper reads the monitor addresses and the secret key up front.
+//-----------------------------------------------------------------------------
+
+func newSysfsMapper(root string, conn cephConn, r *runner) (*sysfsMapper, error) {
+
+	// Defaults as in the ceph tools
+	cluster := conn.cluster
+	if cluster == "" {
+		cluster = "ceph"
+	}
+
+	id := conn.id
+	if id == "" {
+		id = "admin"
+	}
+
+	// Monitor addresses
+	mons := conn.mon
+	if mons == "" {
+		conf := conn.conf
+		if conf == "" {
+			conf = "/etc/ceph/" + cluster + ".conf"
+		}
+		mons = readConfValue(conf, "mon_host")
+	}
+
+	if mons == "" {
+		return nil, errors.New("Unable to find the monitor addresses, use -mon")
+	}
+
+	// The kernel only speaks the v1 protocol
+	if v1 := monV1Regex.FindAllStringSubmatch(mons, -1); len(v1) > 0 {
+		addrs := []string{}
+		for _, sub := range v1 {
+			addrs = append(addrs, sub[1])
+		}
+		mons = strings.Join(addrs, ",")
+	}
+	mons = strings.Join(strings.FieldsFunc(mons, func(r rune) bool {
+		return r == ',' || r == ' ' || r == ';'
+	}), ",")
+
+	// Secret key
+	var secret string
+	if conn.keyfile != "" {
+		data, err := ioutil.ReadFile(conn.keyfile)
+		if err != nil {
+			return nil, errors.New("Unable to read keyfile " + conn.keyfile)
+		}
+		secret = strings.TrimSpace(string(data))
+	} else {
+		keyrings := []string{
+			conn.keyring,
+			"/etc/ceph/" + cluster + ".client." + id + ".keyring",
+			"/etc/ceph/" + cluster + ".keyring",
+			"/etc/ceph/keyring",
+		}
+		for _, keyring := range keyrings {
+			if keyring == "" {
+				continue
+			}
+			if secret = readKeyring(keyring, "client."+id); secret != "" {
+				break
+			}
+		}
+	}
+
+	if secret == "" {
+		return nil, errors.New("Unable to find the key for client." + id)
+	}
+
+	return &sysfsMapper{
+		root:    root,
+		mons:    mons,
+		id:      id,
+		secret:  secret,
+		runner:  r,
+		pending: map[string]bool{},
+	}, nil
+}
+
+//-----------------------------------------------------------------------------
+// mapImage
+//-----------------------------------------------------------------------------
+
+func (m *sysfsMapper) mapImage(pool, name string, opts mapOpts) (string, error) {
+
+	// A late map would race with this one
+	key := pool + "/" + name
+	m.mutex.Lock()
+	if m.pending[key] {
+		m.mutex.Unlock()
+		return "", errors.New("A previous map of " + key + " is still pending")
+	}
+	m.pending[key] = true
+	m.mutex.Unlock()
+
+	// Devices before mapping
+	before, err := m.showMapped()
+	if err != nil {
+		m.done(key)
+		return "", err
+	}
+
+	// Ask the kernel to map the image
+	options := "name=" + m.id + ",secret=" + m.secret
+	if opts.exclusive {
+		options += ",exclusive"
+	}
+	if opts.readOnly {
+		options += ",ro"
+	}
+
+	spec := m.mons + " " + options + " " + pool + " " + name + " -"
+	err = m.runner.call("map", "Unable to map the image to a kernel device", func() error {
+		return m.write("add", spec)
+	}, func(err error) {
+		m.unmapLate(before, pool, name, err)
+		m.done(key)
+	})
+
+	// On timeout the late map clears the pending flag
+	if errorKind(err) != errTimeout {
+		m.done(key)
+	}
+
+	if err != nil {
+		return "", err
+	}
+
+	// Find the new device
+	after, err := m.showMapped()
+	if err != nil {
+		return "", err
+	}
+
+	for device, mp := range after {
+		if _, found := before[device]; !found && mp.pool == pool && mp.name == name {
+			return device, nil
+		}
+	}
+
+	return "", errors.New("Unable to find the kernel device of the image")
+}
+
+//-----------------------------------------------------------------------------
+// done clears the pending flag of an image.
+//-----------------------------------------------------------------------------
+
+func (m *sysfsMapper) done(key string) {
+	m.mutex.Lock()
+	delete(m.pending, key)
+	m.mutex.Unlock()
+}
+
+//-----------------------------------------------------------------------------
+// unmapLate unmaps the device of a map request that finished after its
+// deadline, since the caller already gave up on it. No other map of the image
+// runs meanwhile, so the new device is the late one.
+//-----------------------------------------------------------------------------
+
+func (m *sysfsMapper) unmapLate(before map[string]mapping, pool, name string, err error) {
+
+	if err != nil {
+		log.Printf("[Map] INFO late map of %s/%s failed: %s", pool, name, err)
+		return
+	}
+
+	after, err := m.showMapped()
+	if err != nil {
+		log.Printf("[Map] ERROR late map of %s/%s left an unknown device: %s", pool, name, err)
+		return
+	}
+
+	for device, mp := range after {
+		if _, found := before[device]; !found && mp.pool == pool && mp.name == name {
+			log.Printf("[Map] WARN late map of %s/%s on %s, unmapping it", pool, name, device)
+			if err = m.unmapImage(device); err != nil {
+				log.Printf("[Map] ERROR unable to unmap %s: %s", device, err)
+			}
+		}
+	}
+}
+
+//-----------------------------------------------------------------------------
+// unmapImage
+//-----------------------------------------------------------------------------
+
+func (m *sysfsMapper) unmapImage(device string) error {
+
+	// The kernel wants the device ID
+	sub := deviceRegex.FindStringSubmatch(device)
+	if len(sub) != 2 {
+		return errors.New("Unable to unmap the image from " + device)
+	}
+
+	err := m.runner.call("unmap", "Unable to unmap the image from "+device, func() error {
+		return m.write("remove", sub[1])
+	}, func(err error) {
+		if err != nil {
+			log.Printf("[Unmap] ERROR late unmap of %s failed, it is still mapped: %s", device, err)
+		} else {
+			log.Printf("[Unmap] INFO late unmap of %s finished", device)
+		}
+	})
+
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+//-----------------------------------------------------------------------------
+// showMapped returns the images mapped to kernel devices indexed by device.
+//-----------------------------------------------------------------------------
+
+func (m *sysfsMapper) showMapped() (map[string]mapping, error) {
+
+	mapped := map[string]mapping{}
+
+	// One directory per device
+	dir := filepath.Join(m.root, "bus", "rbd", "devices")
+	entries, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return mapped, nil
+	} else if err != nil {
+		return nil, errors.New("Unable to list the mapped images")
+	}
+
+	for _, e := range entries {
+
+		pool, err1 := ioutil.ReadFile(filepath.Join(dir, e.Name(), "pool"))
+		name, err2 := ioutil.ReadFile(filepath.Join(dir, e.Name(), "name"))
+		if err1 != nil || err2 != nil {
+			continue
+		}
+
+		// Skip mapped snapshots
+		snap, err := ioutil.ReadFile(filepath.Join(dir, e.Name(), "current_snap"))
+		if err == nil && strings.TrimSpace(string(snap)) != "-" {
+			continue
+		}
+
+		device := "/dev/rbd" + e.Name()
+		mapped[device] = mapping{
+			pool:   strings.TrimSpace(string(pool)),
+			name:   strings.TrimSpace(string(name)),
+			device: device,
+		}
+	}
+
+	return mapped, nil
+}
+
+//-----------------------------------------------------------------------------
+// write sends a command to the add or remove bus file, preferring the
+// single_major variants when the kernel has them.
+//-----------------------------------------------------------------------------
+
+func (m *sysfsMapper) write(op, data string) error {
+
+	bus := filepath.Join(m.root, "bus", "rbd")
+	file := filepath.Join(bus, op+"_single_major")
+	if _, err := os.Stat(file); err != nil {
+		file = filepath.Join(bus, op)
+	}
+
+	f, err := os.OpenFile(file, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+
+	if _, err = f.Write([]byte(data)); err != nil {
+		f.Close()
+		return err
+	}
+
+	return f.Close()
+}
+
+//-----------------------------------------------------------------------------
+// readConfValue returns the value of a key in a ceph ini file. Spaces and
+// underscores in key names are equivalent.
+//-----------------------------------------------------------------------------
+
+func readConfValue(file, key string) string {
+
+	f, err := os.Open(file)
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+
+	norm := strings.NewReplacer(" ", "_")
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		kv := strings.SplitN(scanner.Text(), "=", 2)
+		if len(kv) == 2 && norm.Replace(strings.TrimSpace(kv[0])) == key {
+			return strings.TrimSpace(kv[1])
+		}
+	}
+
+	return ""
+}
+
+//-----------------------------------------------------------------------------
+// readKeyring returns the key of an entity in a keyring file.
+//-----------------------------------------------------------------------------
+
+func readKeyring(file, entity string) string {
+
+	f, err := os.Open(file)
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+
+	section := ""
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			section = strings.Trim(line, "[]")
+			continue
+		}
+		kv := strings.SplitN(line, "=", 2)
+		if section == entity && len(kv) == 2 && strings.TrimSpace(kv[0]) == "key" {
+			return strings.TrimSpace(kv[1])
+		}
+	}
+
+	return ""
+}
@@ -0,0 +1,307 @@
+//-----------------------------------------------------------------------------
+// Package membership:
+//-----------------------------------------------------------------------------
+
+package main
+
+//-----------------------------------------------------------------------------
+// Imports:
+//-----------------------------------------------------------------------------
+
+import (
+
+	// Standard library:
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+//-----------------------------------------------------------------------------
+// sysfsTree returns a mapper rooted at a temporary sysfs tree.
+//-----------------------------------------------------------------------------
+
+func sysfsTree(t *testing.T) *sysfsMapper {
+
+	root := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(root, "bus", "rbd", "devices"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := newRunner(10*time.Second, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &sysfsMapper{
+		root:    root,
+		mons:    "10.0.0.1:6789",
+		id:      "admin",
+		secret:  "AQBzY2VwaGtleQ==",
+		runner:  r,
+		pending: map[string]bool{},
+	}
+}
+
+//-----------------------------------------------------------------------------
+// addDevice adds a device to the tree as the kernel does on map.
+//-----------------------------------------------------------------------------
+
+func addDevice(t *testing.T, m *sysfsMapper, id string, files map[string]string) {
+
+	dir := filepath.Join(m.root, "bus", "rbd", "devices", id)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	for file, data := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, file), []byte(data+"\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+//-----------------------------------------------------------------------------
+// fakeKernel makes a bus file a full fifo, so a write to it blocks until the
+// kernel side has run appear. It returns what was written.
+//-----------------------------------------------------------------------------
+
+func fakeKernel(t *testing.T, file string, appear func()) <-chan string {
+
+	if err := syscall.Mkfifo(file, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	// Hold both ends and fill the pipe
+	fd, err := syscall.Open(file, syscall.O_RDWR|syscall.O_NONBLOCK, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for {
+		if _, err = syscall.Write(fd, make([]byte, 4096)); err != nil {
+			break
+		}
+	}
+
+	// The number of open descriptors of the fifo, ours included
+	opened := func() int {
+		n := 0
+		fds, _ := ioutil.ReadDir("/proc/self/fd")
+		for _, e := range fds {
+			if target, _ := os.Readlink("/proc/self/fd/" + e.Name()); target == file {
+				n++
+			}
+		}
+		return n
+	}
+
+	written := make(chan string, 1)
+	go func() {
+		defer syscall.Close(fd)
+
+		// The writer opened the fifo and blocks on the full pipe
+		for opened() < 2 {
+			time.Sleep(time.Millisecond)
+		}
+		appear()
+
+		// Drain until the writer is gone, keeping its bytes
+		data := []byte{}
+		buf := make([]byte, 4096)
+		for closed := false; ; {
+			n, err := syscall.Read(fd, buf)
+			if n > 0 {
+				data = append(data, buf[:n]...)
+			} else if err == syscall.EAGAIN && closed {
+				break
+			} else if err == syscall.EAGAIN {
+				closed = opened() < 2
+				time.Sleep(time.Millisecond)
+			}
+		}
+
+		written <- strings.TrimLeft(string(data), "\x00")
+	}()
+
+	return written
+}
+
+//-----------------------------------------------------------------------------
+// TestSysfsShowMapped
+//-----------------------------------------------------------------------------
+
+func TestSysfsShowMapped(t *testing.T) {
+
+	m := sysfsTree(t)
+	addDevice(t, m, "0", map[string]string{"pool": "rbd", "name": "data", "current_snap": "-"})
+	addDevice(t, m, "1", map[string]string{"pool": "rbd", "name": "data", "current_snap": "daily"})
+	addDevice(t, m, "2", map[string]string{"pool": "ssd", "name": "logs"})
+	addDevice(t, m, "3", map[string]string{"pool": "rbd"})
+
+	mapped, err := m.showMapped()
+	want := map[string]mapping{
+		"/dev/rbd0": {pool: "rbd", name: "data", device: "/dev/rbd0"},
+		"/dev/rbd2": {pool: "ssd", name: "logs", device: "/dev/rbd2"},
+	}
+
+	if err != nil || !reflect.DeepEqual(mapped, want) {
+		t.Errorf("showMapped returned %+v (%v), want %+v", mapped, err, want)
+	}
+
+	// No rbd module loaded
+	if err = os.RemoveAll(filepath.Join(m.root, "bus")); err != nil {
+		t.Fatal(err)
+	}
+
+	if mapped, err = m.showMapped(); err != nil || len(mapped) != 0 {
+		t.Errorf("showMapped without devices returned %+v (%v)", mapped, err)
+	}
+}
+
+//-----------------------------------------------------------------------------
+// TestSysfsMap
+//-----------------------------------------------------------------------------
+
+func TestSysfsMap(t *testing.T) {
+
+	m := sysfsTree(t)
+	addDevice(t, m, "0", map[string]string{"pool": "rbd", "name": "data", "current_snap": "daily"})
+
+	written := fakeKernel(t, filepath.Join(m.root, "bus", "rbd", "add_single_major"), func() {
+		addDevice(t, m, "1", map[string]string{"pool": "rbd", "name": "data", "current_snap": "-"})
+	})
+
+	device, err := m.mapImage("rbd", "data", mapOpts{exclusive: true})
+	if err != nil || device != "/dev/rbd1" {
+		t.Fatalf("mapImage returned %q (%v), want /dev/rbd1", device, err)
+	}
+
+	if spec, want := <-written, "10.0.0.1:6789 name=admin,secret=AQBzY2VwaGtleQ==,exclusive rbd data -"; spec != want {
+		t.Errorf("mapImage wrote %q, want %q", spec, want)
+	}
+
+	// A write that maps nothing
+	m = sysfsTree(t)
+	if err = ioutil.WriteFile(filepath.Join(m.root, "bus", "rbd", "add"), nil, 0200); err != nil {
+		t.Fatal(err)
+	}
+
+	if device, err = m.mapImage("rbd", "data", mapOpts{}); err == nil {
+		t.Errorf("mapImage without a new device returned %q", device)
+	}
+
+	if len(m.pending) != 0 {
+		t.Errorf("mapImage left %v pending", m.pending)
+	}
+}
+
+//-----------------------------------------------------------------------------
+// TestSysfsUnmap
+//-----------------------------------------------------------------------------
+
+func TestSysfsUnmap(t *testing.T) {
+
+	m := sysfsTree(t)
+	bus := filepath.Join(m.root, "bus", "rbd")
+
+	for _, file := range []string{"remove", "remove_single_major"} {
+		if err := ioutil.WriteFile(filepath.Join(bus, file), nil, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	written := func(file string) string {
+		data, err := ioutil.ReadFile(filepath.Join(bus, file))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(data)
+	}
+
+	// The single_major variant when the kernel has it
+	if err := m.unmapImage("/dev/rbd3"); err != nil {
+		t.Fatalf("unmapImage: %s", err)
+	}
+
+	if got := written("remove_single_major"); got != "3" || written("remove") != "" {
+		t.Errorf("unmapImage wrote %q to remove_single_major and %q to remove", got, written("remove"))
+	}
+
+	// Older kernels
+	if err := os.Remove(filepath.Join(bus, "remove_single_major")); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := m.unmapImage("/dev/rbd12"); err != nil {
+		t.Fatalf("unmapImage without remove_single_major: %s", err)
+	}
+
+	if got := written("remove"); got != "12" {
+		t.Errorf("unmapImage wrote %q to remove, want 12", got)
+	}
+
+	// Not a kernel RBD device
+	if err := m.unmapImage("/dev/nbd0"); err == nil {
+		t.Error("unmapImage of /dev/nbd0 succeeded")
+	}
+}
+
+//-----------------------------------------------------------------------------
+// TestSysfsConfig reads the monitors and the key as newSysfsMapper does.
+//-----------------------------------------------------------------------------
+
+func TestSysfsConfig(t *testing.T) {
+
+	dir := t.TempDir()
+	conf := filepath.Join(dir, "ceph.conf")
+	keyring := filepath.Join(dir, "ceph.keyring")
+
+	err := ioutil.WriteFile(conf, []byte("[global]\n"+
+		"\tfsid = 0c5a4a6e-9c3b-4f5e-8b1a-2d3e4f5a6b7c\n"+
+		"\tmon host = [v2:10.0.0.1:3300/0,v1:10.0.0.1:6789/0] [v2:10.0.0.2:3300/0,v1:10.0.0.2:6789/0]\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = ioutil.WriteFile(keyring, []byte("[client.admin]\n"+
+		"\tkey = AQBhZG1pbmtleQ==\n"+
+		"\tcaps mon = \"allow *\"\n"+
+		"[client.docker]\n"+
+		"\tkey = AQBkb2NrZXJrZXk=\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got := readConfValue(conf, "mon_host"); !strings.HasPrefix(got, "[v2:10.0.0.1:3300/0") {
+		t.Errorf("readConfValue of mon_host returned %q", got)
+	}
+
+	if got := readConfValue(conf, "mon_initial_members"); got != "" {
+		t.Errorf("readConfValue of a missing key returned %q", got)
+	}
+
+	for entity, want := range map[string]string{"client.admin": "AQBhZG1pbmtleQ==", "client.docker": "AQBkb2NrZXJrZXk=", "client.other": ""} {
+		if got := readKeyring(keyring, entity); got != want {
+			t.Errorf("readKeyring of %s returned %q, want %q", entity, got, want)
+		}
+	}
+
+	// The kernel gets the v1 addresses only, without nonces
+	m, err := newSysfsMapper("/sys", cephConn{id: "docker", conf: conf, keyring: keyring}, nil)
+	if err != nil {
+		t.Fatalf("newSysfsMapper: %s", err)
+	}
+
+	if m.mons != "10.0.0.1:6789,10.0.0.2:6789" || m.id != "docker" || m.secret != "AQBkb2NrZXJrZXk=" {
+		t.Errorf("newSysfsMapper returned mons %q, id %q and secret %q", m.mons, m.id, m.secret)
+	}
+
+	if _, err = newSysfsMapper("/sys", cephConn{id: "other", conf: conf, keyring: keyring}, nil); err == nil {
+		t.Error("newSysfsMapper succeeded without a key")
+	}
+}
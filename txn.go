@@ -0,0 +1,159 @@
+//-----------------------------------------------------------------------------
+// Package membership:
+//-----------------------------------------------------------------------------
+
+package main
+
+//-----------------------------------------------------------------------------
+// Imports:
+//-----------------------------------------------------------------------------
+
+import (
+
+	// Standard library:
+	"errors"
+	"log"
+	"strings"
+	"time"
+)
+
+//-----------------------------------------------------------------------------
+// Package constant declarations factored into a block:
+//-----------------------------------------------------------------------------
+
+const (
+	undoAttempts = 3
+	undoBackoff  = time.Second
+)
+
+//-----------------------------------------------------------------------------
+// Structs definitions:
+//-----------------------------------------------------------------------------
+
+// step is a completed operation and the way to revert it.
+type step struct {
+	name string
+	undo func() error
+}
+
+// txn runs the steps of an operation. If the operation does not commit, the
+// completed steps are undone in reverse order, each undo retried on failure.
+type txn struct {
+	tag       string
+	steps     []step
+	committed bool
+}
+
+//-----------------------------------------------------------------------------
+// newTxn
+//-----------------------------------------------------------------------------
+
+func newTxn(tag string) *txn {
+	return &txn{tag: tag}
+}
+
+//-----------------------------------------------------------------------------
+// do runs a step and, if it succeeds, remembers its undo. A nil undo means
+// there is nothing to revert.
+//-----------------------------------------------------------------------------
+
+func (t *txn) do(name string, do func() error, undo func() error) error {
+
+	if err := do(); err != nil {
+		return err
+	}
+
+	if undo != nil {
+		t.steps = append(t.steps, step{name: name, undo: undo})
+	}
+
+	return nil
+}
+
+//-----------------------------------------------------------------------------
+// forget keeps the effect of a step whatever happens next.
+//-----------------------------------------------------------------------------
+
+func (t *txn) forget(name string) {
+	for i, s := range t.steps {
+		if s.name == name {
+			t.steps = append(t.steps[:i], t.steps[i+1:]...)
+			return
+		}
+	}
+}
+
+//-----------------------------------------------------------------------------
+// commit keeps the effects of every step.
+//-----------------------------------------------------------------------------
+
+func (t *txn) commit() {
+	t.committed = true
+}
+
+//-----------------------------------------------------------------------------
+// rollback undoes the completed steps unless the transaction committed. It is
+// meant to be deferred.
+//-----------------------------------------------------------------------------
+
+func (t *txn) rollback() {
+
+	if t.committed {
+		return
+	}
+
+	if len(t.steps) > 0 {
+		log.Printf("[%s] INFO rolling back %d steps", t.tag, len(t.steps))
+	}
+
+	t.unwind()
+}
+
+//-----------------------------------------------------------------------------
+// finish undoes the completed steps as the last part of a successful
+// operation, such as unmapping and unlocking an image after formatting it.
+//-----------------------------------------------------------------------------
+
+func (t *txn) finish() error {
+	t.committed = true
+	return t.unwind()
+}
+
+//-----------------------------------------------------------------------------
+// unwind runs every undo in reverse order. A failed undo is retried and then
+// reported, the remaining ones still run.
+//-----------------------------------------------------------------------------
+
+func (t *txn) unwind() error {
+
+	failed := []string{}
+
+	for i := len(t.steps) - 1; i >= 0; i-- {
+
+		s := t.steps[i]
+		var err error
+
+		for attempt := 1; attempt <= undoAttempts; attempt++ {
+			if err = s.undo(); err == nil {
+				break
+			}
+			log.Printf("[%s] WARN undo %s failed (attempt %d of %d): %s", t.tag, s.name, attempt, undoAttempts, err)
+			if attempt < undoAttempts {
+				time.Sleep(time.Duration(attempt) * undoBackoff)
+			}
+		}
+
+		if err != nil {
+			log.Printf("[%s] ERROR unable to %s, it must be cleaned up by hand", t.tag, s.name)
+			failed = append(failed, s.name+": "+err.Error())
+		}
+	}
+
+	t.steps = nil
+
+	if len(failed) > 0 {
+		return errors.New("Unable to " + strings.Join(failed, "; "))
+	}
+
+	return nil
+}
@@ -0,0 +1,282 @@
+//-----------------------------------------------------------------------------
+// Package membership:
+//-----------------------------------------------------------------------------
+
+package main
+
+//-----------------------------------------------------------------------------
+// Imports:
+//-----------------------------------------------------------------------------
+
+import (
+
+	// Standard library:
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	// Community:
+	dkvolume "github.com/docker/go-plugins-helpers/volume"
+)
+
+//-----------------------------------------------------------------------------
+// TestTxn
+//-----------------------------------------------------------------------------
+
+func TestTxn(t *testing.T) {
+
+	undone := []string{}
+	undo := func(name string) func() error {
+		return func() error {
+			undone = append(undone, name)
+			return nil
+		}
+	}
+
+	// Completed steps are undone in reverse order, failed ones are not
+	tx := newTxn("Test")
+	tx.do("one", func() error { return nil }, undo("one"))
+	tx.do("two", func() error { return nil }, undo("two"))
+	tx.do("none", func() error { return nil }, nil)
+	tx.do("three", func() error { return errors.New("failed") }, undo("three"))
+	tx.rollback()
+
+	if want := []string{"two", "one"}; !reflect.DeepEqual(undone, want) {
+		t.Errorf("rollback undid %v, want %v", undone, want)
+	}
+
+	// A committed transaction keeps everything
+	undone = nil
+	tx = newTxn("Test")
+	tx.do("one", func() error { return nil }, undo("one"))
+	tx.commit()
+	tx.rollback()
+
+	if len(undone) != 0 {
+		t.Errorf("rollback after commit undid %v", undone)
+	}
+
+	// Finishing undoes all but the forgotten steps, once
+	undone = nil
+	tx = newTxn("Test")
+	tx.do("one", func() error { return nil }, undo("one"))
+	tx.do("two", func() error { return nil }, undo("two"))
+	tx.forget("one")
+
+	if err := tx.finish(); err != nil {
+		t.Errorf("finish: %s", err)
+	}
+	tx.rollback()
+
+	if want := []string{"two"}; !reflect.DeepEqual(undone, want) {
+		t.Errorf("finish undid %v, want %v", undone, want)
+	}
+}
+
+//-----------------------------------------------------------------------------
+// TestMountRollback fails every step of Mount in turn and checks that no
+// lock, mapping, mount or recorded client is left behind.
+//-----------------------------------------------------------------------------
+
+func TestMountRollback(t *testing.T) {
+
+	for _, c := range []struct {
+		locking string
+		op      string
+	}{
+		{lockingAdvisory, "lock"},
+		{lockingAdvisory, "map"},
+		{lockingAdvisory, "mkdir"},
+		{lockingAdvisory, "probe"},
+		{lockingAdvisory, "mount"},
+		{lockingExclusive, "info"},
+		{lockingExclusive, "map"},
+		{lockingExclusive, "mount"},
+		{lockingNone, "map"},
+		{lockingNone, "probe"},
+		{lockingNone, "mount"},
+	} {
+		d, f := newTestDriver(t)
+		img := f.addImage("rbd", "data", "xfs")
+		img.meta[metaLocking] = c.locking
+
+		// A file where the mountpoint directory goes
+		if c.op == "mkdir" {
+			if err := ioutil.WriteFile(filepath.Join(d.volRoot, "ceph"), nil, 0600); err != nil {
+				t.Fatal(err)
+			}
+		} else {
+			f.fail(c.op)
+		}
+
+		if r := d.Mount(dkvolume.MountRequest{Name: "data", ID: "c1"}); r.Err == "" {
+			t.Errorf("Mount with %s locking and a failed %s succeeded", c.locking, c.op)
+			continue
+		}
+
+		if left := f.leaks(); len(left) > 0 {
+			t.Errorf("Mount with %s locking and a failed %s left %v", c.locking, c.op, left)
+		}
+
+		if _, found := img.meta[metaClient]; found {
+			t.Errorf("Mount with %s locking and a failed %s kept the recorded client", c.locking, c.op)
+		}
+
+		if len(d.volumes) != 0 {
+			t.Errorf("Mount with %s locking and a failed %s registered the volume", c.locking, c.op)
+		}
+
+		// Nothing in the way of the next attempt
+		f.heal(c.op)
+		if c.op != "mkdir" {
+			if r := d.Mount(dkvolume.MountRequest{Name: "data", ID: "c1"}); r.Err != "" {
+				t.Errorf("Mount with %s locking after a failed %s: %s", c.locking, c.op, r.Err)
+			}
+		}
+	}
+}
+
+//-----------------------------------------------------------------------------
+// TestLockerFailure checks that a lock whose locker cannot be listed is given
+// back.
+//-----------------------------------------------------------------------------
+
+func TestLockerFailure(t *testing.T) {
+
+	d, f := newTestDriver(t)
+	f.addImage("rbd", "data", "xfs")
+	f.failOnce("locks")
+
+	if r := d.Mount(dkvolume.MountRequest{Name: "data", ID: "c1"}); r.Err == "" {
+		t.Fatal("Mount succeeded without the locker")
+	}
+
+	if left := f.leaks(); len(left) > 0 {
+		t.Errorf("Mount without the locker left %v", left)
+	}
+
+	if r := d.Mount(dkvolume.MountRequest{Name: "data", ID: "c1"}); r.Err != "" {
+		t.Errorf("Mount after a failed locks: %s", r.Err)
+	}
+}
+
+//-----------------------------------------------------------------------------
+// TestMountRecordFailure checks that Mount goes on without a recorded client.
+//-----------------------------------------------------------------------------
+
+func TestMountRecordFailure(t *testing.T) {
+
+	for _, op := range []string{"watchers", "meta"} {
+
+		d, f := newTestDriver(t)
+		img := f.addImage("rbd", "data", "xfs")
+		f.fail(op)
+
+		if r := d.Mount(dkvolume.MountRequest{Name: "data", ID: "c1"}); r.Err != "" {
+			t.Errorf("Mount with a failed %s: %s", op, r.Err)
+			continue
+		}
+
+		if _, found := img.meta[metaClient]; found {
+			t.Errorf("Mount with a failed %s recorded a client", op)
+		}
+
+		f.heal(op)
+		if r := d.Unmount(dkvolume.UnmountRequest{Name: "data", ID: "c1"}); r.Err != "" {
+			t.Errorf("Unmount after a failed %s: %s", op, r.Err)
+		}
+
+		if left := f.leaks(); len(left) > 0 {
+			t.Errorf("Unmount after a failed %s left %v", op, left)
+		}
+	}
+}
+
+//-----------------------------------------------------------------------------
+// TestCreateRollback fails every step of Create in turn and checks that the
+// image is removed and no lock, mapping or mount is left behind.
+//-----------------------------------------------------------------------------
+
+func TestCreateRollback(t *testing.T) {
+
+	for _, c := range []struct {
+		locking string
+		op      string
+	}{
+		{lockingAdvisory, "create"},
+		{lockingAdvisory, "meta"},
+		{lockingAdvisory, "lock"},
+		{lockingAdvisory, "map"},
+		{lockingAdvisory, "probe"},
+		{lockingAdvisory, "mkfs"},
+		{lockingExclusive, "info"},
+		{lockingExclusive, "map"},
+		{lockingExclusive, "mkfs"},
+		{lockingNone, "map"},
+		{lockingNone, "mkfs"},
+	} {
+		d, f := newTestDriver(t)
+		f.fail(c.op)
+
+		r := d.Create(dkvolume.Request{Name: "data", Options: map[string]string{"locking": c.locking}})
+		if r.Err == "" {
+			t.Errorf("Create with %s locking and a failed %s succeeded", c.locking, c.op)
+			continue
+		}
+
+		if f.hasImage("rbd", "data") {
+			t.Errorf("Create with %s locking and a failed %s kept the image", c.locking, c.op)
+		}
+
+		if left := f.leaks(); len(left) > 0 {
+			t.Errorf("Create with %s locking and a failed %s left %v", c.locking, c.op, left)
+		}
+
+		// Nothing in the way of the next attempt
+		f.heal(c.op)
+		if r = d.Create(dkvolume.Request{Name: "data", Options: map[string]string{"locking": c.locking}}); r.Err != "" {
+			t.Errorf("Create with %s locking after a failed %s: %s", c.locking, c.op, r.Err)
+		}
+	}
+}
+
+//-----------------------------------------------------------------------------
+// TestCreateDirtyDevice checks that a device holding data is not formatted
+// and the new image is removed.
+//-----------------------------------------------------------------------------
+
+func TestCreateDirtyDevice(t *testing.T) {
+
+	d, f := newTestDriver(t)
+	d.host = &fakeDirty{fakeCeph: f, fstype: "ext4"}
+
+	if r := d.Create(dkvolume.Request{Name: "data"}); r.Err == "" {
+		t.Fatal("Create formatted a device holding a file system")
+	}
+
+	if f.hasImage("rbd", "data") {
+		t.Error("Create kept the image of a dirty device")
+	}
+
+	if left := f.leaks(); len(left) > 0 {
+		t.Errorf("Create of a dirty device left %v", left)
+	}
+}
+
+//-----------------------------------------------------------------------------
+// fakeDirty reports a file system on every device.
+//-----------------------------------------------------------------------------
+
+type fakeDirty struct {
+	*fakeCeph
+	fstype string
+}
+
+func (f *fakeDirty) probeDevice(device string) (string, string, error) {
+	if _, _, err := f.fakeCeph.probeDevice(device); err != nil {
+		return "", "", err
+	}
+	return f.fstype, "", nil
+}